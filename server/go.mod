@@ -3,6 +3,7 @@ module github.com/n0n4/worthtracker
 go 1.16
 
 require (
-	github.com/go-sql-driver/mysql v1.6.0 // indirect
-	github.com/mattn/go-sqlite3 v1.14.7 // indirect
+	github.com/go-sql-driver/mysql v1.6.0
+	github.com/mattn/go-sqlite3 v1.14.7
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 )
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// The body of every error response from the api
+// Code is stable for clients to act on, Message is meant for people
+// and Field names the request field at fault, when there is one
+type ErrorResponse struct {
+	Code    string
+	Field   string `json:",omitempty"`
+	Message string
+	// the resource as it stands now, for conflicting changes
+	Current interface{} `json:",omitempty"`
+}
+
+// The request itself could not be understood, such as a malformed body or parameter
+type InvalidRequestError struct {
+	Field  string
+	Reason string
+}
+
+func (err *InvalidRequestError) Error() string {
+	return "Invalid request: " + err.Reason
+}
+
+type MethodNotAllowedError struct {
+	Method string
+}
+
+func (err *MethodNotAllowedError) Error() string {
+	return "Invalid request method: " + err.Method
+}
+
+type RouteDoesNotExistError struct {
+	Path string
+}
+
+func (err *RouteDoesNotExistError) Error() string {
+	return "There is nothing at '" + err.Path + "'."
+}
+
+// Maps an error to the status and body we respond with
+// Errors we do not recognise are internal, and their details are not shared with the client
+func describeError(err error) (int, ErrorResponse) {
+	// the request ran out of time, or was abandoned, before the work could finish
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout, ErrorResponse{Code: "timeout", Message: "The request took too long and was stopped."}
+	} else if errors.Is(err, context.Canceled) {
+		return http.StatusServiceUnavailable, ErrorResponse{Code: "cancelled", Message: "The request was cancelled before it could finish."}
+	}
+
+	message := err.Error()
+	for unwrapped := err; unwrapped != nil; unwrapped = errors.Unwrap(unwrapped) {
+		switch typed := unwrapped.(type) {
+		case *InvalidRequestError:
+			return http.StatusBadRequest, ErrorResponse{Code: "invalid_request", Field: typed.Field, Message: message}
+		case *MethodNotAllowedError:
+			return http.StatusMethodNotAllowed, ErrorResponse{Code: "method_not_allowed", Message: message}
+		case *RouteDoesNotExistError:
+			return http.StatusNotFound, ErrorResponse{Code: "route_not_found", Message: message}
+		case *NotReadyError:
+			return http.StatusServiceUnavailable, ErrorResponse{Code: "not_ready", Message: message}
+
+		// users and sessions
+		case *InvalidUserNameError:
+			return http.StatusBadRequest, ErrorResponse{Code: "invalid_user_name", Field: "Name", Message: message}
+		case *InvalidDisplayNameError:
+			return http.StatusBadRequest, ErrorResponse{Code: "invalid_display_name", Field: "DisplayName", Message: message}
+		case *InvalidLocaleError:
+			return http.StatusBadRequest, ErrorResponse{Code: "invalid_locale", Field: "Locale", Message: message}
+		case *InvalidFiscalYearStartError:
+			return http.StatusBadRequest, ErrorResponse{Code: "invalid_fiscal_year_start", Field: "FiscalYearStart", Message: message}
+		case *UserAlreadyExistsError:
+			return http.StatusConflict, ErrorResponse{Code: "user_already_exists", Field: "Name", Message: message}
+		case *UserDoesNotExistError:
+			return http.StatusNotFound, ErrorResponse{Code: "user_not_found", Message: message}
+		case *UserForbiddenError:
+			return http.StatusForbidden, ErrorResponse{Code: "user_forbidden", Message: message}
+		case *InvalidPasswordError:
+			return http.StatusBadRequest, ErrorResponse{Code: "invalid_password", Field: "Password", Message: message}
+		case *InvalidCredentialsError:
+			return http.StatusUnauthorized, ErrorResponse{Code: "invalid_credentials", Message: message}
+		case *PasswordNotSetError:
+			return http.StatusUnauthorized, ErrorResponse{Code: "password_not_set", Message: message}
+		case *NotAuthenticatedError:
+			return http.StatusUnauthorized, ErrorResponse{Code: "not_authenticated", Message: message}
+
+		// items
+		case *InvalidItemNameError:
+			return http.StatusBadRequest, ErrorResponse{Code: "invalid_item_name", Field: "Name", Message: message}
+		case *InvalidItemTypeError:
+			return http.StatusBadRequest, ErrorResponse{Code: "invalid_item_type", Field: "Type", Message: message}
+		case *InvalidItemCategoryError:
+			return http.StatusBadRequest, ErrorResponse{Code: "invalid_item_category", Field: "Category", Message: message}
+		case *InvalidItemTagError:
+			return http.StatusBadRequest, ErrorResponse{Code: "invalid_item_tag", Field: "Tags", Message: message}
+		case *InvalidItemValueError:
+			return http.StatusBadRequest, ErrorResponse{Code: "invalid_item_value", Field: "Value", Message: message}
+		case *ItemDoesNotExistError:
+			return http.StatusNotFound, ErrorResponse{Code: "item_not_found", Field: "Id", Message: message}
+		case *ItemVersionConflictError:
+			response := ErrorResponse{Code: "item_version_conflict", Field: "Version", Message: message}
+			if typed.Current != nil {
+				response.Current = typed.Current
+			}
+			if typed.Precondition {
+				return http.StatusPreconditionFailed, response
+			}
+			return http.StatusConflict, response
+		case *ItemVersionRequiredError:
+			return http.StatusPreconditionRequired, ErrorResponse{Code: "item_version_required", Field: "Version", Message: message}
+		case *ItemForbiddenError:
+			return http.StatusForbidden, ErrorResponse{Code: "item_forbidden", Field: "Id", Message: message}
+		case *InvalidItemQueryError:
+			return http.StatusBadRequest, ErrorResponse{Code: "invalid_item_query", Message: message}
+		case *InvalidBatchError:
+			return http.StatusBadRequest, ErrorResponse{Code: "invalid_batch", Message: message}
+
+		// currencies, snapshots, imports and exports
+		case *InvalidCurrencyError:
+			return http.StatusBadRequest, ErrorResponse{Code: "invalid_currency", Field: "Currency", Message: message}
+		case *InvalidExchangeRateError:
+			return http.StatusBadRequest, ErrorResponse{Code: "invalid_exchange_rate", Message: message}
+		case *MissingExchangeRateError:
+			// the request is fine, but can't be served until the rate is added
+			return http.StatusConflict, ErrorResponse{Code: "missing_exchange_rate", Field: "Currency", Message: message}
+		case *InvalidDateError:
+			return http.StatusBadRequest, ErrorResponse{Code: "invalid_date", Message: message}
+		case *InvalidImportError:
+			return http.StatusBadRequest, ErrorResponse{Code: "invalid_import", Message: message}
+		case *InvalidAmountError:
+			return http.StatusBadRequest, ErrorResponse{Code: "invalid_amount", Field: "Value", Message: message}
+		case *InvalidExportFormatError:
+			return http.StatusBadRequest, ErrorResponse{Code: "invalid_export_format", Field: "format", Message: message}
+		}
+	}
+
+	return http.StatusInternalServerError, ErrorResponse{Code: "internal_error", Message: "Something went wrong on our end."}
+}
+
+// Responds to a request with the status and JSON body for an error
+func writeError(writer http.ResponseWriter, request *http.Request, err error) {
+	status, response := describeError(err)
+	if status == http.StatusInternalServerError {
+		logError(request.Context(), "Internal error", errorField(err))
+	} else if response.Code == "timeout" || response.Code == "cancelled" {
+		logWarn(request.Context(), "Request stopped", errorField(err))
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("X-Content-Type-Options", "nosniff")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(response)
+}
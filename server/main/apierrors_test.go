@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDescribeError(t *testing.T) {
+	for _, test := range []struct {
+		err    error
+		status int
+		code   string
+		field  string
+	}{
+		{&InvalidRequestError{Field: "limit", Reason: "Must be a number."}, http.StatusBadRequest, "invalid_request", "limit"},
+		{&MethodNotAllowedError{Method: "TRACE"}, http.StatusMethodNotAllowed, "method_not_allowed", ""},
+		{&RouteDoesNotExistError{Path: "/api/v2/nothing"}, http.StatusNotFound, "route_not_found", ""},
+		{&UserAlreadyExistsError{Name: "alice"}, http.StatusConflict, "user_already_exists", "Name"},
+		{&UserForbiddenError{Name: "bob"}, http.StatusForbidden, "user_forbidden", ""},
+		{&InvalidCredentialsError{}, http.StatusUnauthorized, "invalid_credentials", ""},
+		{&NotAuthenticatedError{}, http.StatusUnauthorized, "not_authenticated", ""},
+		{&InvalidItemTypeError{Type: "Car"}, http.StatusBadRequest, "invalid_item_type", "Type"},
+		{&ItemDoesNotExistError{Id: 7}, http.StatusNotFound, "item_not_found", "Id"},
+		{&ItemForbiddenError{Id: 7}, http.StatusForbidden, "item_forbidden", "Id"},
+		{&ItemVersionConflictError{Id: 7, Version: 1}, http.StatusConflict, "item_version_conflict", "Version"},
+		{&ItemVersionConflictError{Id: 7, Version: 1, Precondition: true}, http.StatusPreconditionFailed, "item_version_conflict", "Version"},
+		{&ItemVersionRequiredError{Id: 7}, http.StatusPreconditionRequired, "item_version_required", "Version"},
+		{&MissingExchangeRateError{Currency: "EUR", Base: "USD"}, http.StatusConflict, "missing_exchange_rate", "Currency"},
+		{&InvalidExportFormatError{Format: "xml"}, http.StatusBadRequest, "invalid_export_format", "format"},
+		{&NotReadyError{Reason: "The database cannot be reached."}, http.StatusServiceUnavailable, "not_ready", ""},
+		// errors are recognised through any wrapping
+		{fmt.Errorf("adding: %w", &ItemDoesNotExistError{Id: 7}), http.StatusNotFound, "item_not_found", "Id"},
+		{&MigrationFailedError{Version: 3, Err: &InvalidCurrencyError{Currency: "XX"}}, http.StatusBadRequest, "invalid_currency", "Currency"},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout, "timeout", ""},
+		{fmt.Errorf("query: %w", context.DeadlineExceeded), http.StatusGatewayTimeout, "timeout", ""},
+		{fmt.Errorf("query: %w", context.Canceled), http.StatusServiceUnavailable, "cancelled", ""},
+	} {
+		status, response := describeError(test.err)
+		if status != test.status || response.Code != test.code || response.Field != test.field {
+			t.Errorf("%T gave %d %s on %q, want %d %s on %q", test.err, status, response.Code, response.Field,
+				test.status, test.code, test.field)
+		}
+		if response.Message == "" {
+			t.Errorf("%T has no message", test.err)
+		}
+	}
+}
+
+func TestUnrecognisedErrorsAreInternal(t *testing.T) {
+	status, response := describeError(errors.New("Error 1062: Duplicate entry 'alice' for key 'users.name'"))
+	if status != http.StatusInternalServerError || response.Code != "internal_error" {
+		t.Errorf("gave %d %s, want 500 internal_error", status, response.Code)
+	}
+	if strings.Contains(response.Message, "alice") || strings.Contains(response.Message, "1062") {
+		t.Errorf("the details were shared: %s", response.Message)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	current := &ItemEntry{Id: 7, Version: 2}
+	writeError(recorder, httptest.NewRequest(http.MethodPut, "/api/item", nil),
+		&ItemVersionConflictError{Id: 7, Version: 1, Current: current})
+
+	if recorder.Code != http.StatusConflict || recorder.Header().Get("Content-Type") != "application/json" ||
+		recorder.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("wrote %d with headers %v", recorder.Code, recorder.Header())
+	}
+	var response struct {
+		Code    string
+		Field   string
+		Message string
+		Current *ItemEntry
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Code != "item_version_conflict" || response.Field != "Version" || response.Current == nil || response.Current.Version != 2 {
+		t.Errorf("wrote %+v, want the conflict with the current item", response)
+	}
+}
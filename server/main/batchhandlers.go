@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// the most operations a single batch may hold
+	maxBatchOperations = 500
+
+	batchOpCreate = "create"
+	batchOpUpdate = "update"
+	batchOpPatch  = "patch"
+	batchOpDelete = "delete"
+)
+
+type batchHandlers struct {
+	da DataAccess
+}
+
+// One change to the user's items within a batch
+// Create takes Item, update takes Id, Version and Item, patch takes Id, Version
+// and a JSON Merge Patch, and delete takes Id and Version
+type BatchOperation struct {
+	Op      string
+	Id      int
+	Version int
+	Item    *itemDocument
+	Patch   map[string]interface{}
+}
+
+// The outcome of one operation, Status is what the single item endpoint would have responded with
+// When an atomic batch is rolled back the operations before the failure report 424 and rolled_back
+type BatchOperationResult struct {
+	Index  int
+	Op     string
+	Status int
+	Item   *ItemEntry     `json:",omitempty"`
+	Error  *ErrorResponse `json:",omitempty"`
+}
+
+type BatchResult struct {
+	Atomic bool
+	// whether the changes were kept, an atomic batch keeps nothing if any operation failed
+	Committed bool
+	Results   []BatchOperationResult
+}
+
+type InvalidBatchError struct {
+	Reason string
+}
+
+func (err *InvalidBatchError) Error() string {
+	return "Invalid batch: " + err.Reason
+}
+
+// Runs a list of item operations for the user in a single transaction
+// Operations run in order, so later ones see the effects of earlier ones
+// In atomic mode the first failure stops the batch and rolls back everything;
+// otherwise failed operations are skipped and the rest are committed
+func RunItemBatch(context context.Context, da DataAccess, user *UserEntry, operations []BatchOperation, atomic bool) (*BatchResult, error) {
+	if len(operations) == 0 {
+		return nil, &InvalidBatchError{Reason: "There are no operations."}
+	} else if len(operations) > maxBatchOperations {
+		return nil, &InvalidBatchError{Reason: fmt.Sprintf("There can be at most %d operations.", maxBatchOperations)}
+	}
+
+	result := BatchResult{Atomic: atomic, Results: make([]BatchOperationResult, 0, len(operations))}
+	var failed error
+	err := da.WithTransaction(context, func(tx DataAccess) error {
+		for i := range operations {
+			item, status, err := runBatchOperation(context, tx, user, &operations[i])
+			operationResult := BatchOperationResult{Index: i, Op: operations[i].Op, Status: status, Item: item}
+			if err != nil {
+				var response ErrorResponse
+				operationResult.Status, response = describeError(err)
+				operationResult.Error = &response
+			}
+			result.Results = append(result.Results, operationResult)
+
+			if err != nil && atomic {
+				failed = err
+				return err
+			}
+		}
+		return nil
+	})
+
+	if failed != nil {
+		// the operation's own error is in the results, and nothing was kept, so the ones
+		// before it mustn't hand out items and ids which no longer exist
+		failedIndex := len(result.Results) - 1
+		for i := 0; i < failedIndex; i++ {
+			result.Results[i].Status = http.StatusFailedDependency
+			result.Results[i].Item = nil
+			result.Results[i].Error = &ErrorResponse{Code: "rolled_back",
+				Message: fmt.Sprintf("Rolled back because operation %d failed.", failedIndex)}
+		}
+		return &result, nil
+	} else if err != nil {
+		return nil, err
+	}
+	result.Committed = true
+	return &result, nil
+}
+
+// Helper method to run one operation of a batch, giving the stored item and the status to report
+func runBatchOperation(context context.Context, da DataAccess, user *UserEntry, operation *BatchOperation) (*ItemEntry, int, error) {
+	switch operation.Op {
+	case batchOpCreate, batchOpUpdate:
+		if operation.Item == nil {
+			return nil, 0, &InvalidBatchError{Reason: "A " + operation.Op + " operation needs an Item."}
+		}
+		fields := operation.Item
+		item := ItemEntry{Id: operation.Id, Name: fields.Name, Type: fields.Type, Category: fields.Category,
+			Currency: fields.Currency, Value: fields.Value, Tags: fields.Tags, Version: operation.Version}
+
+		if operation.Op == batchOpCreate {
+			stored, err := AddItem(context, da, user, &item)
+			return stored, http.StatusCreated, err
+		}
+		stored, err := UpdateItem(context, da, user, &item)
+		return stored, http.StatusOK, err
+	case batchOpPatch:
+		if operation.Patch == nil {
+			return nil, 0, &InvalidBatchError{Reason: "A patch operation needs a Patch."}
+		}
+		stored, err := PatchItem(context, da, user, operation.Id, operation.Patch, operation.Version)
+		return stored, http.StatusOK, err
+	case batchOpDelete:
+		err := DeleteItem(context, da, user, operation.Id, operation.Version)
+		return nil, http.StatusNoContent, err
+	}
+
+	return nil, 0, &InvalidBatchError{Reason: "'" + operation.Op + "' is not an operation, must be " + batchOpCreate + ", " +
+		batchOpUpdate + ", " + batchOpPatch + " or " + batchOpDelete + "."}
+}
+
+// Handles the incoming http requests to change many items at once
+// The body is a list of operations, and an "atomic" query parameter of
+// true rolls back every operation if any one of them fails
+func (bh batchHandlers) ItemBatchRequestHandler(writer http.ResponseWriter, request *http.Request) {
+	writeAPIHeaders(writer, request)
+
+	switch request.Method {
+	case http.MethodOptions:
+		return
+	case http.MethodPost:
+		atomic := false
+		if value := request.URL.Query().Get("atomic"); value != "" {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				writeError(writer, request, &InvalidRequestError{Field: "atomic", Reason: "Must be true or false."})
+				return
+			}
+			atomic = parsed
+		}
+
+		var operations []BatchOperation
+		decoder := json.NewDecoder(request.Body)
+		// keep large values in patches exact
+		decoder.UseNumber()
+		if err := decoder.Decode(&operations); err != nil {
+			writeError(writer, request, &InvalidRequestError{Reason: err.Error()})
+			return
+		}
+
+		result, err := RunItemBatch(request.Context(), bh.da, requestUser(request), operations, atomic)
+		if err != nil {
+			logWarn(request.Context(), "Failed to run item batch", errorField(err))
+			writeError(writer, request, err)
+			return
+		}
+
+		// an atomic batch which was rolled back responds with the failed operation's status
+		if !result.Committed {
+			failed := result.Results[len(result.Results)-1]
+			writer.WriteHeader(failed.Status)
+		}
+		json.NewEncoder(writer).Encode(result)
+	default:
+		writeError(writer, request, &MethodNotAllowedError{Method: request.Method})
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAtomicBatchRollsBackEveryOperation(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.login(t, "alice")
+	item := addTestItem(alice, "House", 500)
+
+	// the delete is based on an old version, so the create and update before it go too
+	operations := []map[string]interface{}{
+		{"Op": batchOpCreate, "Item": map[string]interface{}{"Name": "Car", "Type": ItemTypeAsset, "Value": 100}},
+		{"Op": batchOpUpdate, "Id": item.Id, "Version": 1, "Item": map[string]interface{}{"Name": "House", "Type": ItemTypeAsset, "Value": 600}},
+		{"Op": batchOpDelete, "Id": item.Id, "Version": 1},
+	}
+	content := alice.expect(http.MethodPost, "/api/itembatch?atomic=true", operations, http.StatusConflict)
+
+	var result BatchResult
+	decodeTestBody(t, content, &result)
+	if result.Committed || len(result.Results) != 3 {
+		t.Fatalf("batch gave %s, want three results and nothing committed", content)
+	}
+	for _, operation := range result.Results[:2] {
+		if operation.Status != http.StatusFailedDependency || operation.Item != nil ||
+			operation.Error == nil || operation.Error.Code != "rolled_back" {
+			t.Errorf("operation %d reported %+v, want it rolled back", operation.Index, operation)
+		}
+	}
+	if failed := result.Results[2]; failed.Error == nil || failed.Error.Code != "item_version_conflict" {
+		t.Errorf("delete reported %+v, want a version conflict", failed)
+	}
+
+	var list ItemList
+	decodeTestBody(t, alice.expect(http.MethodPost, "/api/itemlist", nil, http.StatusOK), &list)
+	if list.Count != 1 {
+		t.Errorf("%d items after rolling back, want 1", list.Count)
+	}
+	expectItemUnchanged(t, api.da, item)
+}
+
+func TestBatchKeepsWhatSucceeded(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.login(t, "alice")
+
+	operations := []map[string]interface{}{
+		{"Op": batchOpCreate, "Item": map[string]interface{}{"Name": "Car", "Type": ItemTypeAsset, "Value": 100}},
+		{"Op": batchOpDelete, "Id": 1000, "Version": 1},
+	}
+	var result BatchResult
+	decodeTestBody(t, alice.expect(http.MethodPost, "/api/itembatch", operations, http.StatusOK), &result)
+	if !result.Committed || result.Results[0].Status != http.StatusCreated || result.Results[0].Item == nil ||
+		result.Results[1].Status != http.StatusNotFound {
+		t.Errorf("batch gave %+v, want the create kept and the delete not found", result)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Running the binary with arguments performs a one-off task instead of serving
+const commandUsage = `Usage:
+  worthtracker                     run the server
+  worthtracker migrate status      list the migrations and whether they have been applied
+  worthtracker migrate up          apply every pending migration
+  worthtracker migrate <version>   apply the pending migrations up to a version
+  worthtracker rates import <file> store exchange rates from a CSV of currency,base,rate,date
+  worthtracker import [-strict] <user> <file>
+                                   add items to a user from a CSV of name,type,value[,category,currency,tags]
+                                   or from a .json export
+  worthtracker password <user>     set a user's password, read from the first line of standard input
+                                   accounts made before passwords were added need one to log in
+
+Options, which go before any command:
+  -config <file>          a JSON config file of the settings below (default worthtracker.json when it exists)
+  -listen <address>       the address to serve on (default :3000)
+  -driver <name>          the database driver, sqlite3 or mysql (default sqlite3)
+  -dsn <source>           the data source name for the database, for sqlite3 the database file
+  -static <dir>           the directory the client is served from, empty serves only the api
+  -cors-origins <list>    comma separated origins which may call the api with the session,
+                          * for any origin without it, empty for none (default http://localhost:8080,
+                          where the client's dev server runs)
+  -log-level <level>      debug, info, warn or error (default info)
+  -log-format <format>    how log lines are written, logfmt or json (default logfmt)
+  -log-redact             leave user names and financial values out of the logs
+  -request-timeout <d>    how long a request may run before its work is cancelled (default 30s)
+  -shutdown-timeout <d>   how long requests in flight are given to finish when stopping (default 15s)
+
+Each option can also be set with a WORTHTRACKER_ environment variable, such as WORTHTRACKER_DSN
+or WORTHTRACKER_CORS_ORIGINS, which the flags override and which override the config file
+Without a dsn anywhere else, database.txt is read as before`
+
+type InvalidCommandError struct {
+	Reason string
+}
+
+func (err *InvalidCommandError) Error() string {
+	return err.Reason + "\n" + commandUsage
+}
+
+// Runs the command line mode named by the arguments, input is what the password command reads
+func runCommand(da DataAccess, args []string, input io.Reader) error {
+	var command func() error
+	switch args[0] {
+	case "migrate":
+		// the one command which leaves the schema as it is unless asked
+		return runMigrateCommand(da, args[1:])
+	case "rates":
+		command = func() error { return runRatesCommand(da, args[1:]) }
+	case "import":
+		command = func() error { return runImportCommand(da, args[1:]) }
+	case "password":
+		command = func() error { return runPasswordCommand(da, args[1:], input) }
+	default:
+		return &InvalidCommandError{Reason: "Unknown command '" + args[0] + "'."}
+	}
+
+	// the rest work on the tables as this build knows them, so bring
+	// an older database up to date first, as the server does
+	if err := da.Standup(context.Background()); err != nil {
+		return err
+	}
+	return command()
+}
+
+// Shows the migration status or migrates the database to a given version
+func runMigrateCommand(da DataAccess, args []string) error {
+	if len(args) != 1 {
+		return &InvalidCommandError{Reason: "The migrate command takes exactly one argument."}
+	}
+
+	switch args[0] {
+	case "status":
+		// nothing to do but report
+	case "up":
+		if err := da.Standup(context.Background()); err != nil {
+			return err
+		}
+	default:
+		version, err := strconv.Atoi(args[0])
+		if err != nil {
+			return &InvalidCommandError{Reason: "'" + args[0] + "' is not a migration version."}
+		}
+		if err := da.Migrate(context.Background(), version); err != nil {
+			return err
+		}
+	}
+
+	return printMigrations(da)
+}
+
+// Helper method to print every migration and when it was applied
+func printMigrations(da DataAccess) error {
+	migrations, err := da.GetMigrations(context.Background())
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "VERSION\tAPPLIED\tDESCRIPTION")
+	for _, m := range *migrations {
+		applied := "pending"
+		if m.Applied != nil {
+			applied = m.Applied.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(writer, "%d\t%s\t%s\n", m.Version, applied, m.Description)
+	}
+	return writer.Flush()
+}
+
+// Imports exchange rates from a CSV file
+func runRatesCommand(da DataAccess, args []string) error {
+	if len(args) != 2 || args[0] != "import" {
+		return &InvalidCommandError{Reason: "The rates command takes 'import' and a file name."}
+	}
+
+	file, err := os.Open(args[1])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	count, err := ImportExchangeRates(context.Background(), da, file)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %d exchange rates.\n", count)
+	return nil
+}
+
+// Imports items for a user from a CSV file
+func runImportCommand(da DataAccess, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	strict := flags.Bool("strict", false, "import nothing unless every row is valid")
+	if err := flags.Parse(args); err != nil {
+		return &InvalidCommandError{Reason: err.Error()}
+	}
+	if flags.NArg() != 2 {
+		return &InvalidCommandError{Reason: "The import command takes a user name and a file name."}
+	}
+
+	user, err := FindUserByName(context.Background(), da, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	importer := ImportItems
+	if strings.HasSuffix(strings.ToLower(flags.Arg(1)), ".json") {
+		importer = ImportDocument
+	}
+
+	result, err := importer(context.Background(), da, user, file, *strict)
+	if err != nil {
+		return err
+	}
+
+	for _, rowError := range result.Errors {
+		fmt.Printf("Line %d: %s\n", rowError.Line, rowError.Error)
+	}
+	fmt.Printf("Imported %d items.\n", result.Imported)
+	if result.ImportedSnapshots > 0 {
+		fmt.Printf("Imported %d snapshots.\n", result.ImportedSnapshots)
+	}
+	return nil
+}
+
+// Sets a user's password, which is read from the input so it stays out of the shell's history
+func runPasswordCommand(da DataAccess, args []string, input io.Reader) error {
+	if len(args) != 1 {
+		return &InvalidCommandError{Reason: "The password command takes a user name."}
+	}
+
+	user, err := FindUserByName(context.Background(), da, args[0])
+	if err != nil {
+		return err
+	}
+
+	line, err := bufio.NewReader(input).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if err := SetPassword(context.Background(), da, user, strings.TrimRight(line, "\r\n")); err != nil {
+		return err
+	}
+
+	fmt.Printf("Set the password for '%s'.\n", user.Name)
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Helper method to get a database at the first schema version with one user on it,
+// as an install from before passwords would have
+func openBaselineDataAccess(t *testing.T) DataAccess {
+	t.Helper()
+	da := openTestDataAccess(t, sqliteDialect.driver, filepath.Join(t.TempDir(), "test.db"), true)
+	if err := da.Migrate(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := da.(DataAccessSQL).database.Exec("INSERT INTO users (name) VALUES ('alice')"); err != nil {
+		t.Fatal(err)
+	}
+	return da
+}
+
+func TestPasswordCommandMigratesFirst(t *testing.T) {
+	da := openBaselineDataAccess(t)
+	if err := runCommand(da, []string{"password", "alice"}, strings.NewReader("password123\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if current, latest, err := da.GetSchemaVersion(context.Background()); err != nil || current != latest {
+		t.Errorf("schema version %d of %d after the command: %v", current, latest, err)
+	}
+	if _, _, _, err := Login(context.Background(), da, "alice", "password123"); err != nil {
+		t.Errorf("logging in with the new password gave %v", err)
+	}
+}
+
+func TestImportCommandMigratesFirst(t *testing.T) {
+	da := openBaselineDataAccess(t)
+	file := filepath.Join(t.TempDir(), "items.csv")
+	if err := ioutil.WriteFile(file, []byte("name,type,value\nHouse,Asset,500\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCommand(da, []string{"import", "alice", file}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := da.FindUserByName(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := da.GetItemsByUser(context.Background(), user.Id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*items) != 1 || (*items)[0].Value != 50000 {
+		t.Errorf("imported %+v, want the house at 50000", *items)
+	}
+}
+
+func TestUnknownCommandLeavesTheSchema(t *testing.T) {
+	da := openBaselineDataAccess(t)
+	if err := runCommand(da, []string{"frobnicate"}, nil); err == nil {
+		t.Error("an unknown command succeeded")
+	}
+	if current, _, err := da.GetSchemaVersion(context.Background()); err != nil || current != 1 {
+		t.Errorf("schema version %d after an unknown command: %v", current, err)
+	}
+}
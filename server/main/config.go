@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// read when it exists, unless another file is named with -config or WORTHTRACKER_CONFIG
+	defaultConfigFile = "worthtracker.json"
+	configEnvPrefix   = "WORTHTRACKER_"
+	// older installs keep their database endpoint in this, it is still read when present
+	legacyEndpointFile = "database.txt"
+	// where the client's development server (npm run serve) runs, it calls the api from there
+	clientDevOrigin = "http://localhost:8080"
+)
+
+// Everything the server can be configured with
+// Each setting is taken from the first of these that has it: command line flags,
+// environment variables, the config file, the legacy database.txt and then the defaults
+type Config struct {
+	// the address to serve on, such as :3000 or 127.0.0.1:8080
+	Listen string
+	Driver string
+	// the data source name handed to the driver, for sqlite this is the database file
+	DSN string
+	// where the built client is served from, empty serves only the api
+	StaticDir string
+	// the origins whose pages may call the api with the user's session, the client's dev server by default
+	// * lets any origin call it, but without the session
+	CORSOrigins []string
+	// one of debug, info, warn or error
+	LogLevel string
+	// how log lines are written, logfmt or json
+	LogFormat string
+	// leaves user names and financial values out of the logs
+	LogRedact bool
+	// how long a request may run before its work is cancelled, such as 30s
+	RequestTimeout string
+	// how long requests in flight are given to finish when the server is stopped, such as 15s
+	ShutdownTimeout string
+
+	// the settings above which aren't strings, filled in by validate
+	requestTimeout  time.Duration
+	shutdownTimeout time.Duration
+}
+
+type InvalidConfigError struct {
+	Setting string
+	Reason  string
+}
+
+func (err *InvalidConfigError) Error() string {
+	return "Invalid " + err.Setting + " setting: " + err.Reason
+}
+
+func defaultConfig() Config {
+	return Config{
+		Listen:          ":3000",
+		Driver:          sqliteDialect.driver,
+		StaticDir:       "./../client/dist",
+		CORSOrigins:     []string{clientDevOrigin},
+		LogLevel:        "info",
+		LogFormat:       logFormatLogfmt,
+		RequestTimeout:  "30s",
+		ShutdownTimeout: "15s",
+	}
+}
+
+// Loads and validates the configuration for a run of the binary
+// The flags come before any command, so what is left of the arguments is returned for runCommand
+func LoadConfig(args []string) (*Config, []string, error) {
+	flags := flag.NewFlagSet("worthtracker", flag.ContinueOnError)
+	configFile := flags.String("config", "", "the JSON config file to read (default "+defaultConfigFile+" when it exists)")
+	listen := flags.String("listen", "", "the address to serve on")
+	driver := flags.String("driver", "", "the database driver, "+sqliteDialect.driver+" or "+mysqlDialect.driver)
+	dsn := flags.String("dsn", "", "the data source name for the database")
+	staticDir := flags.String("static", "", "the directory the client is served from")
+	corsOrigins := flags.String("cors-origins", "", "comma separated origins which may call the api with the session, * for any without it")
+	logLevel := flags.String("log-level", "", "debug, info, warn or error")
+	logFormat := flags.String("log-format", "", "how log lines are written, "+logFormatLogfmt+" or "+logFormatJSON)
+	logRedact := flags.Bool("log-redact", false, "leave user names and financial values out of the logs")
+	requestTimeout := flags.String("request-timeout", "", "how long a request may run before its work is cancelled")
+	shutdownTimeout := flags.String("shutdown-timeout", "", "how long requests in flight are given to finish when stopping")
+	// the usage is ours to print, along with the commands
+	flags.SetOutput(ioutil.Discard)
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return nil, nil, err
+	} else if err != nil {
+		return nil, nil, &InvalidCommandError{Reason: err.Error()}
+	}
+
+	config := defaultConfig()
+	if err := config.readLegacyFile(); err != nil {
+		return nil, nil, err
+	}
+
+	// a config file which was asked for has to be there
+	path, required := *configFile, true
+	if path == "" {
+		path = os.Getenv(configEnvPrefix + "CONFIG")
+	}
+	if path == "" {
+		path, required = defaultConfigFile, false
+	}
+	if err := config.readFile(path, required); err != nil {
+		return nil, nil, err
+	}
+
+	if err := config.readEnvironment(); err != nil {
+		return nil, nil, err
+	}
+
+	// only the flags which were given override anything
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			config.Listen = *listen
+		case "driver":
+			config.Driver = *driver
+		case "dsn":
+			config.DSN = *dsn
+		case "static":
+			config.StaticDir = *staticDir
+		case "cors-origins":
+			config.CORSOrigins = splitConfigList(*corsOrigins)
+		case "log-level":
+			config.LogLevel = *logLevel
+		case "log-format":
+			config.LogFormat = *logFormat
+		case "log-redact":
+			config.LogRedact = *logRedact
+		case "request-timeout":
+			config.RequestTimeout = *requestTimeout
+		case "shutdown-timeout":
+			config.ShutdownTimeout = *shutdownTimeout
+		}
+	})
+
+	if err := config.validate(); err != nil {
+		return nil, nil, err
+	}
+	return &config, flags.Args(), nil
+}
+
+// Helper method to read the endpoint from database.txt, which is optional
+func (config *Config) readLegacyFile() error {
+	buffer, err := ioutil.ReadFile(legacyEndpointFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return &InvalidConfigError{Setting: legacyEndpointFile, Reason: err.Error()}
+	}
+	config.DSN = strings.TrimSpace(string(buffer))
+	return nil
+}
+
+// Helper method to read the settings in a JSON config file over the current ones
+func (config *Config) readFile(path string, required bool) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) && !required {
+		return nil
+	} else if err != nil {
+		return &InvalidConfigError{Setting: "config file", Reason: err.Error()}
+	}
+	defer file.Close()
+
+	// misspelt settings would otherwise be silently ignored
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return &InvalidConfigError{Setting: "config file", Reason: path + ": " + err.Error()}
+	}
+	return nil
+}
+
+// Helper method to read the WORTHTRACKER_ environment variables over the current settings
+func (config *Config) readEnvironment() error {
+	for name, value := range map[string]*string{
+		"LISTEN":           &config.Listen,
+		"DRIVER":           &config.Driver,
+		"DSN":              &config.DSN,
+		"STATIC_DIR":       &config.StaticDir,
+		"LOG_LEVEL":        &config.LogLevel,
+		"LOG_FORMAT":       &config.LogFormat,
+		"REQUEST_TIMEOUT":  &config.RequestTimeout,
+		"SHUTDOWN_TIMEOUT": &config.ShutdownTimeout,
+	} {
+		if set, ok := os.LookupEnv(configEnvPrefix + name); ok {
+			*value = set
+		}
+	}
+	if set, ok := os.LookupEnv(configEnvPrefix + "CORS_ORIGINS"); ok {
+		config.CORSOrigins = splitConfigList(set)
+	}
+	if set, ok := os.LookupEnv(configEnvPrefix + "LOG_REDACT"); ok {
+		redact, err := strconv.ParseBool(strings.TrimSpace(set))
+		if err != nil {
+			return &InvalidConfigError{Setting: "log-redact", Reason: "'" + set + "' must be true or false."}
+		}
+		config.LogRedact = redact
+	}
+	return nil
+}
+
+// Helper method to split a comma separated setting, dropping empty entries
+func splitConfigList(value string) []string {
+	list := make([]string, 0)
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// Helper method to check every setting, tidying them up where that is harmless
+func (config *Config) validate() error {
+	config.Listen = strings.TrimSpace(config.Listen)
+	if _, port, err := net.SplitHostPort(config.Listen); err != nil {
+		return &InvalidConfigError{Setting: "listen", Reason: "Must be a host and port such as :3000, " + err.Error()}
+	} else if number, err := strconv.Atoi(port); err != nil || number < 0 || number > 65535 {
+		return &InvalidConfigError{Setting: "listen", Reason: "'" + port + "' is not a port."}
+	}
+
+	config.Driver = strings.TrimSpace(config.Driver)
+	if config.Driver != sqliteDialect.driver && config.Driver != mysqlDialect.driver {
+		return &InvalidConfigError{Setting: "driver", Reason: (&UnsupportedDriverError{Driver: config.Driver}).Error()}
+	}
+
+	config.DSN = strings.TrimSpace(config.DSN)
+	if config.DSN == "" {
+		return &InvalidConfigError{Setting: "dsn", Reason: "Must be set with -dsn, " + configEnvPrefix + "DSN, the config file or " + legacyEndpointFile + "."}
+	}
+
+	if config.StaticDir != "" {
+		// a missing directory only means the client hasn't been built, but a file is a mistake
+		if info, err := os.Stat(config.StaticDir); err == nil && !info.IsDir() {
+			return &InvalidConfigError{Setting: "static", Reason: "'" + config.StaticDir + "' is not a directory."}
+		}
+	}
+
+	for i, origin := range config.CORSOrigins {
+		if origin == "*" {
+			continue
+		}
+		parsed, err := url.Parse(origin)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" ||
+			strings.Trim(parsed.Path, "/") != "" || parsed.RawQuery != "" {
+			return &InvalidConfigError{Setting: "cors-origins", Reason: "'" + origin + "' is not an origin such as https://example.com."}
+		}
+		// browsers send the origin without a trailing slash
+		config.CORSOrigins[i] = parsed.Scheme + "://" + parsed.Host
+	}
+
+	config.LogLevel = strings.ToLower(strings.TrimSpace(config.LogLevel))
+	if _, ok := logLevelNames[config.LogLevel]; !ok {
+		return &InvalidConfigError{Setting: "log-level", Reason: "'" + config.LogLevel + "' must be debug, info, warn or error."}
+	}
+
+	config.LogFormat = strings.ToLower(strings.TrimSpace(config.LogFormat))
+	if config.LogFormat != logFormatLogfmt && config.LogFormat != logFormatJSON {
+		return &InvalidConfigError{Setting: "log-format", Reason: "'" + config.LogFormat + "' must be " + logFormatLogfmt + " or " + logFormatJSON + "."}
+	}
+
+	for _, setting := range []struct {
+		name   string
+		value  string
+		parsed *time.Duration
+	}{
+		{"request-timeout", config.RequestTimeout, &config.requestTimeout},
+		{"shutdown-timeout", config.ShutdownTimeout, &config.shutdownTimeout},
+	} {
+		timeout, err := time.ParseDuration(strings.TrimSpace(setting.value))
+		if err != nil || timeout <= 0 {
+			return &InvalidConfigError{Setting: setting.name, Reason: "'" + setting.value + "' is not a length of time such as 15s."}
+		}
+		*setting.parsed = timeout
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Helper method to load the config from a directory holding the given files,
+// with only the given WORTHTRACKER_ environment variables set
+func loadTestConfig(t *testing.T, files map[string]string, env map[string]string, args ...string) (*Config, []string, error) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	working, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(working)
+
+	saved := make(map[string]string)
+	for _, variable := range os.Environ() {
+		if name := strings.SplitN(variable, "=", 2)[0]; strings.HasPrefix(name, configEnvPrefix) {
+			saved[name] = os.Getenv(name)
+			os.Unsetenv(name)
+		}
+	}
+	for name, value := range env {
+		os.Setenv(configEnvPrefix+name, value)
+	}
+	defer func() {
+		for name := range env {
+			os.Unsetenv(configEnvPrefix + name)
+		}
+		for name, value := range saved {
+			os.Setenv(name, value)
+		}
+	}()
+
+	return LoadConfig(args)
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	legacy := map[string]string{legacyEndpointFile: " legacy-dsn \n"}
+	withFile := map[string]string{legacyEndpointFile: "legacy-dsn",
+		defaultConfigFile: `{"DSN": "file-dsn", "Listen": ":4000", "LogLevel": "warn"}`}
+	env := map[string]string{"DSN": "env-dsn", "LISTEN": ":5000"}
+
+	for _, test := range []struct {
+		name   string
+		files  map[string]string
+		env    map[string]string
+		args   []string
+		dsn    string
+		listen string
+	}{
+		{"legacy file", legacy, nil, nil, "legacy-dsn", ":3000"},
+		{"config file", withFile, nil, nil, "file-dsn", ":4000"},
+		{"environment", withFile, env, nil, "env-dsn", ":5000"},
+		{"flags", withFile, env, []string{"-dsn", "flag-dsn"}, "flag-dsn", ":5000"},
+	} {
+		config, _, err := loadTestConfig(t, test.files, test.env, test.args...)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if config.DSN != test.dsn || config.Listen != test.listen {
+			t.Errorf("%s gave dsn %q and listen %q, want %q and %q", test.name, config.DSN, config.Listen, test.dsn, test.listen)
+		}
+	}
+
+	// settings nothing overrides come through from further down
+	config, _, err := loadTestConfig(t, withFile, env, "-dsn", "flag-dsn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.LogLevel != "warn" {
+		t.Errorf("log level %q, want the file's warn", config.LogLevel)
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	config, args, err := loadTestConfig(t, nil, nil, "-dsn", "test.db", "migrate", "up")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Listen != ":3000" || config.Driver != sqliteDialect.driver || config.LogLevel != "info" ||
+		config.LogFormat != logFormatLogfmt || config.LogRedact ||
+		!reflect.DeepEqual(config.CORSOrigins, []string{clientDevOrigin}) {
+		t.Errorf("defaults were %+v", config)
+	}
+	if config.requestTimeout != 30*time.Second || config.shutdownTimeout != 15*time.Second {
+		t.Errorf("timeouts %v and %v, want 30s and 15s", config.requestTimeout, config.shutdownTimeout)
+	}
+	if !reflect.DeepEqual(args, []string{"migrate", "up"}) {
+		t.Errorf("left %v for the command, want migrate up", args)
+	}
+}
+
+func TestConfigTidiesSettings(t *testing.T) {
+	config, _, err := loadTestConfig(t, nil, map[string]string{"CORS_ORIGINS": "https://app.example/, ,http://localhost:8080",
+		"LOG_LEVEL": " DEBUG ", "LOG_REDACT": "true"}, "-dsn", "test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.CORSOrigins, []string{"https://app.example", "http://localhost:8080"}) {
+		t.Errorf("origins %v", config.CORSOrigins)
+	}
+	if config.LogLevel != "debug" || !config.LogRedact {
+		t.Errorf("log level %q and redaction %v, want debug and on", config.LogLevel, config.LogRedact)
+	}
+
+	// an empty list turns the default origin off
+	config, _, err = loadTestConfig(t, nil, nil, "-dsn", "test.db", "-cors-origins", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.CORSOrigins) != 0 {
+		t.Errorf("origins %v, want none", config.CORSOrigins)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	for _, test := range []struct {
+		files   map[string]string
+		env     map[string]string
+		args    []string
+		setting string
+	}{
+		{nil, nil, []string{"-dsn", "x", "-listen", "nowhere"}, "listen"},
+		{nil, nil, []string{"-dsn", "x", "-listen", ":99999"}, "listen"},
+		{nil, nil, []string{"-dsn", "x", "-driver", "postgres"}, "driver"},
+		{nil, nil, nil, "dsn"},
+		{nil, nil, []string{"-dsn", "x", "-cors-origins", "app.example"}, "cors-origins"},
+		{nil, nil, []string{"-dsn", "x", "-log-level", "loud"}, "log-level"},
+		{nil, nil, []string{"-dsn", "x", "-log-format", "xml"}, "log-format"},
+		{nil, nil, []string{"-dsn", "x", "-request-timeout", "-1s"}, "request-timeout"},
+		{nil, map[string]string{"SHUTDOWN_TIMEOUT": "soon"}, []string{"-dsn", "x"}, "shutdown-timeout"},
+		{nil, map[string]string{"LOG_REDACT": "maybe"}, []string{"-dsn", "x"}, "log-redact"},
+		{map[string]string{"static": "a file"}, nil, []string{"-dsn", "x", "-static", "static"}, "static"},
+		{map[string]string{defaultConfigFile: `{"Dsn": "x", "Listn": ":4000"}`}, nil, nil, "config file"},
+		{nil, nil, []string{"-config", "missing.json"}, "config file"},
+	} {
+		_, _, err := loadTestConfig(t, test.files, test.env, test.args...)
+		var invalid *InvalidConfigError
+		if !errors.As(err, &invalid) || invalid.Setting != test.setting {
+			t.Errorf("%v with %v gave %v, want an invalid %s setting", test.args, test.env, err, test.setting)
+		}
+	}
+
+	var invalid *InvalidCommandError
+	if _, _, err := loadTestConfig(t, nil, nil, "-nonsense"); !errors.As(err, &invalid) {
+		t.Errorf("an unknown flag gave %v, want an InvalidCommandError", err)
+	}
+	if _, _, err := loadTestConfig(t, nil, nil, "-h"); err != flag.ErrHelp {
+		t.Errorf("-h gave %v, want flag.ErrHelp", err)
+	}
+}
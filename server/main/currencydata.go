@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+const (
+	DefaultCurrency = "USD"
+	// REPLACE INTO is understood by both sqlite and mysql
+	setExchangeRateCommand = `
+REPLACE INTO exchange_rates (currency, base, rate, effective) VALUES ($1, $2, $3, $4)
+`
+	getExchangeRatesCommand = `
+SELECT currency, base, rate, effective FROM exchange_rates ORDER BY currency, base, effective
+`
+)
+
+// One unit of Currency was worth Rate units of Base from Date onwards
+type ExchangeRateEntry struct {
+	Currency string
+	Base     string
+	Rate     float64
+	Date     time.Time
+}
+
+func (da DataAccessSQL) SetExchangeRate(context context.Context, rate *ExchangeRateEntry) error {
+	_, err := da.runner().ExecContext(context, da.bind(setExchangeRateCommand), rate.Currency, rate.Base, rate.Rate, rate.Date.Unix())
+	return err
+}
+
+func (da DataAccessSQL) GetExchangeRates(context context.Context) (*[]ExchangeRateEntry, error) {
+	rows, err := da.runner().QueryContext(context, da.bind(getExchangeRatesCommand))
+	// make sure to clean up rows when we're finished
+	defer func() {
+		if rows != nil {
+			rows.Close()
+		}
+	}()
+
+	rates := make([]ExchangeRateEntry, 0)
+	if err == sql.ErrNoRows {
+		return &rates, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// process the rows into ExchangeRateEntries
+	for rows.Next() {
+		// check for errors
+		err = rows.Err()
+		if err != nil {
+			return nil, err
+		}
+
+		// scan the next row
+		var currency, base string
+		var rate float64
+		var effective int64
+		err = rows.Scan(&currency, &base, &rate, &effective)
+		if err != nil {
+			return nil, err
+		}
+
+		rates = append(rates, ExchangeRateEntry{Currency: currency, Base: base, Rate: rate, Date: time.Unix(effective, 0).UTC()})
+	}
+
+	return &rates, nil
+}
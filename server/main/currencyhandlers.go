@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type currencyHandlers struct {
+	da DataAccess
+}
+
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+type InvalidCurrencyError struct {
+	Currency string
+}
+
+func (err *InvalidCurrencyError) Error() string {
+	return err.Currency + " is an invalid currency: Must be a three letter ISO 4217 code."
+}
+
+type InvalidExchangeRateError struct {
+	Reason string
+}
+
+func (err *InvalidExchangeRateError) Error() string {
+	return "Invalid exchange rate: " + err.Reason
+}
+
+type MissingExchangeRateError struct {
+	Currency string
+	Base     string
+}
+
+func (err *MissingExchangeRateError) Error() string {
+	return "There is no exchange rate from " + err.Currency + " to " + err.Base + "."
+}
+
+// Helper method to tidy up a currency code and verify it looks like ISO 4217
+func normalizeCurrency(currency string) (string, error) {
+	normalized := strings.ToUpper(strings.TrimSpace(currency))
+	if !currencyPattern.MatchString(normalized) {
+		return "", &InvalidCurrencyError{Currency: currency}
+	}
+	return normalized, nil
+}
+
+// A set of exchange rates to convert values with
+type exchangeRateTable []ExchangeRateEntry
+
+// Finds the rate from one currency into another in effect at a given time
+// When there is no rate between the two, it goes through a third currency
+// which has rates to both (e.g. EUR to GBP by way of USD)
+func (table exchangeRateTable) find(currency string, base string, at time.Time) (*ExchangeRateEntry, error) {
+	if currency == base {
+		return &ExchangeRateEntry{Currency: currency, Base: base, Rate: 1}, nil
+	}
+
+	if found := table.direct(currency, base, at); found != nil {
+		return found, nil
+	}
+
+	for i := range table {
+		for _, middle := range []string{table[i].Currency, table[i].Base} {
+			if middle == currency || middle == base {
+				continue
+			}
+			first := table.direct(currency, middle, at)
+			second := table.direct(middle, base, at)
+			if first == nil || second == nil {
+				continue
+			}
+
+			// the combined rate is only as fresh as the older of the two
+			date := first.Date
+			if second.Date.Before(date) {
+				date = second.Date
+			}
+			return &ExchangeRateEntry{Currency: currency, Base: base, Rate: first.Rate * second.Rate, Date: date}, nil
+		}
+	}
+
+	return nil, &MissingExchangeRateError{Currency: currency, Base: base}
+}
+
+// Helper method to find the most recent rate between two currencies in effect at a given time
+// A rate works in both directions, so USD to EUR also covers EUR to USD
+func (table exchangeRateTable) direct(currency string, base string, at time.Time) *ExchangeRateEntry {
+	var found *ExchangeRateEntry
+	for i := range table {
+		rate := &table[i]
+		if rate.Date.After(at) || (found != nil && !rate.Date.After(found.Date)) {
+			continue
+		}
+		if rate.Currency == currency && rate.Base == base {
+			found = rate
+		} else if rate.Currency == base && rate.Base == currency {
+			found = &ExchangeRateEntry{Currency: currency, Base: base, Rate: 1 / rate.Rate, Date: rate.Date}
+		}
+	}
+
+	return found
+}
+
+// Converts a value using an exchange rate, rounding to the nearest unit
+func convertValue(value int64, rate float64) int64 {
+	return int64(math.Round(float64(value) * rate))
+}
+
+// Helper method to tidy up and validate an exchange rate
+func validateExchangeRate(rate *ExchangeRateEntry) error {
+	var err error
+	if rate.Currency, err = normalizeCurrency(rate.Currency); err != nil {
+		return err
+	}
+	if rate.Base, err = normalizeCurrency(rate.Base); err != nil {
+		return err
+	}
+	if rate.Currency == rate.Base {
+		return &InvalidExchangeRateError{Reason: "The currency and base must differ."}
+	}
+	if rate.Rate <= 0 || math.IsInf(rate.Rate, 0) || math.IsNaN(rate.Rate) {
+		return &InvalidExchangeRateError{Reason: "The rate must be greater than zero."}
+	}
+
+	// rates change at most daily
+	rate.Date = rate.Date.UTC().Truncate(24 * time.Hour)
+	return nil
+}
+
+// Helper method to parse the day from which an exchange rate applies
+func parseRateDate(date string) (time.Time, error) {
+	parsed, err := time.Parse(dateLayout, strings.TrimSpace(date))
+	if err != nil {
+		return time.Time{}, &InvalidDateError{Value: date, Reason: "Must be formatted as YYYY-MM-DD."}
+	}
+	return parsed, nil
+}
+
+// Performs validation on exchange rates and then tries to store them
+// Nothing is stored unless every rate is valid, and storing a rate
+// for a pair and date which already has one replaces it
+func SetExchangeRates(context context.Context, da DataAccess, rates []ExchangeRateEntry) error {
+	for i := range rates {
+		if err := validateExchangeRate(&rates[i]); err != nil {
+			return err
+		}
+	}
+
+	return da.WithTransaction(context, func(tx DataAccess) error {
+		for i := range rates {
+			if err := tx.SetExchangeRate(context, &rates[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Reads exchange rates from a CSV file with a header row followed by
+// currency,base,rate,date rows, and stores every one of them
+func ImportExchangeRates(context context.Context, da DataAccess, reader io.Reader) (int, error) {
+	records, err := csv.NewReader(reader).ReadAll()
+	if err != nil {
+		return 0, err
+	}
+
+	rates := make([]ExchangeRateEntry, 0, len(records))
+	for i, record := range records {
+		// skip the header
+		if i == 0 {
+			continue
+		}
+		if len(record) != 4 {
+			return 0, &InvalidExchangeRateError{Reason: fmt.Sprintf("Line %d must have 4 columns: currency,base,rate,date.", i+1)}
+		}
+
+		rate, err := strconv.ParseFloat(strings.TrimSpace(record[2]), 64)
+		if err != nil {
+			return 0, &InvalidExchangeRateError{Reason: fmt.Sprintf("Line %d: '%s' is not a number.", i+1, record[2])}
+		}
+		date, err := parseRateDate(record[3])
+		if err != nil {
+			return 0, fmt.Errorf("Line %d: %w", i+1, err)
+		}
+
+		entry := ExchangeRateEntry{Currency: record[0], Base: record[1], Rate: rate, Date: date}
+		if err := validateExchangeRate(&entry); err != nil {
+			return 0, fmt.Errorf("Line %d: %w", i+1, err)
+		}
+		rates = append(rates, entry)
+	}
+
+	if err := SetExchangeRates(context, da, rates); err != nil {
+		return 0, err
+	}
+	return len(rates), nil
+}
+
+// Handles the incoming http requests for exchange rates
+// GET lists every stored rate; the rates are shared by every user, so they
+// can only be changed by whoever runs the server, see 'worthtracker rates import'
+func (ch currencyHandlers) ExchangeRateRequestHandler(writer http.ResponseWriter, request *http.Request) {
+	writeAPIHeaders(writer, request)
+
+	switch request.Method {
+	case http.MethodOptions:
+		return
+	case http.MethodGet:
+		rates, err := ch.da.GetExchangeRates(request.Context())
+		if err != nil {
+			writeError(writer, request, err)
+			return
+		}
+
+		json.NewEncoder(writer).Encode(rates)
+	default:
+		writer.Header().Set("Allow", "GET, OPTIONS")
+		writeError(writer, request, &MethodNotAllowedError{Method: request.Method})
+	}
+}
@@ -3,8 +3,8 @@ package main
 import (
 	"context"
 	"database/sql"
-
-	_ "github.com/mattn/go-sqlite3"
+	"regexp"
+	"time"
 )
 
 // DataAccess is our entryway for all database related functionality
@@ -17,26 +17,148 @@ import (
 type DataAccess interface {
 	Close()
 	Standup(context.Context) error
+	// checks the database can still be reached
+	Ping(context.Context) error
+	// runs work against a DataAccess whose changes are committed together once work
+	// returns nil, or rolled back if it returns an error; nested calls join the outer transaction
+	WithTransaction(context.Context, func(DataAccess) error) error
+	// migration methods
+	Migrate(context.Context, int) error
+	GetMigrations(context.Context) (*[]MigrationEntry, error)
+	// the schema version the database is at, and the latest one this build knows of
+	GetSchemaVersion(context.Context) (int, int, error)
+	// how many users, items and snapshots are stored
+	CountRecords(context.Context) (*RecordCounts, error)
 	// user methods
-	AddUser(context.Context, string) error
+	AddUser(context.Context, string, string) error
 	FindUserByName(context.Context, string) (*UserEntry, error)
+	FindUserById(context.Context, int) (*UserEntry, error)
 	GetUsers(context.Context) (*[]UserEntry, error)
-	// item methods
-	AddItem(context.Context, int, string, string, int64) error
-	UpdateItem(context.Context, int, int, string, string, int64) error
-	DeleteItem(context.Context, int) error
-	GetItemsByUser(context.Context, int) (*[]ItemEntry, error)
+	// saves the user's name and profile settings, the password is left alone
+	UpdateUser(context.Context, *UserEntry) error
+	SetPasswordHash(context.Context, int, string) error
+	// removes the user along with everything they own
+	DeleteUser(context.Context, int) error
+	// session methods
+	AddSession(context.Context, string, int, int64) error
+	FindSession(context.Context, string) (*SessionEntry, error)
+	DeleteSession(context.Context, string) error
+	DeleteExpiredSessions(context.Context, int64) error
+	// logs the user out everywhere
+	DeleteUserSessions(context.Context, int) error
+	// item methods, adding or updating returns the item as stored
+	AddItem(context.Context, *ItemEntry) (*ItemEntry, error)
+	AddItems(context.Context, *[]ItemEntry) error
+	UpdateItem(context.Context, *ItemEntry) (*ItemEntry, error)
+	DeleteItem(context.Context, int, int) error
+	GetItemsByUser(context.Context, int, *ItemQuery) (*[]ItemEntry, error)
 	FindItemById(context.Context, int) (*ItemEntry, error)
+	GetItemHistory(context.Context, int) (*[]ItemValueEntry, error)
+	// exchange rate methods
+	SetExchangeRate(context.Context, *ExchangeRateEntry) error
+	GetExchangeRates(context.Context) (*[]ExchangeRateEntry, error)
+	// snapshot methods
+	AddSnapshot(context.Context, *SnapshotEntry) (int, error)
+	// gets the snapshots taken within [from, to], a zero to has no end
+	GetSnapshotsByUser(context.Context, int, time.Time, time.Time) (*[]SnapshotEntry, error)
+	// when the latest snapshot at or before a time was taken, zero if there is none
+	GetLatestSnapshotTime(context.Context, int, time.Time) (time.Time, error)
 }
 
 // DataAccessSQL is our actual DataAccess layer for this case
+// The same queries serve every supported engine, the dialect covers the differences
 type DataAccessSQL struct {
 	database *sql.DB
+	dialect  *sqlDialect
+	// set inside WithTransaction, every command then runs as part of it
+	tx *sql.Tx
+}
+
+// Anything commands can run against: the database, a transaction or a savepoint
+type sqlRunner interface {
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+	QueryRowContext(context.Context, string, ...interface{}) *sql.Row
+}
+
+// A group of commands which take effect together or not at all
+type sqlTransaction interface {
+	sqlRunner
+	Commit() error
+	Rollback() error
+}
+
+// Part of a larger transaction which can still be undone on its own
+// Rollback after Commit does nothing, as with sql.Tx, so it can be deferred
+type sqlSavepoint struct {
+	*sql.Tx
+	context context.Context
+	done    bool
+}
+
+const savepointName = "worthtracker_step"
+
+func (sp *sqlSavepoint) Commit() error {
+	sp.done = true
+	_, err := sp.Tx.ExecContext(sp.context, "RELEASE SAVEPOINT "+savepointName)
+	return err
+}
+
+func (sp *sqlSavepoint) Rollback() error {
+	if sp.done {
+		return nil
+	}
+	sp.done = true
+	if _, err := sp.Tx.ExecContext(sp.context, "ROLLBACK TO SAVEPOINT "+savepointName); err != nil {
+		return err
+	}
+	_, err := sp.Tx.ExecContext(sp.context, "RELEASE SAVEPOINT "+savepointName)
+	return err
+}
+
+// Everything that differs between the database engines we support
+type sqlDialect struct {
+	// name of the database/sql driver
+	driver string
+	// every schema change ever made, in order, see migrations.go
+	migrations []migration
+	// whether the driver wants ? placeholders rather than $1, $2, ...
+	positional bool
+	// adjusts the endpoint before it is handed to the driver, nil leaves it as is
+	configure func(string) string
+	// switch foreign key enforcement for the current connection, see migration.withoutForeignKeys
+	foreignKeysOff string
+	foreignKeysOn  string
+	// whether an error is the driver refusing a value already in a UNIQUE column
+	uniqueViolation func(error) bool
+}
+
+var placeholderPattern = regexp.MustCompile(`\$[0-9]+`)
+
+type UnsupportedDriverError struct {
+	Driver string
+}
+
+func (err *UnsupportedDriverError) Error() string {
+	return "Unsupported database driver '" + err.Driver + "', must be " + sqliteDialect.driver + " or " + mysqlDialect.driver
 }
 
-func OpenDataAccess(endpoint string) (DataAccess, error) {
-	database, err := sql.Open("sqlite3", endpoint)
-	da := DataAccess(DataAccessSQL{database: database})
+func OpenDataAccess(driver string, endpoint string) (DataAccess, error) {
+	var dialect *sqlDialect
+	switch driver {
+	case sqliteDialect.driver:
+		dialect = &sqliteDialect
+	case mysqlDialect.driver:
+		dialect = &mysqlDialect
+	default:
+		return nil, &UnsupportedDriverError{Driver: driver}
+	}
+
+	if dialect.configure != nil {
+		endpoint = dialect.configure(endpoint)
+	}
+	database, err := sql.Open(dialect.driver, endpoint)
+	da := DataAccess(DataAccessSQL{database: database, dialect: dialect})
 
 	return da, err
 }
@@ -45,25 +167,64 @@ func (da DataAccessSQL) Close() {
 	da.database.Close()
 }
 
-const (
-	standupSchema = `
-CREATE TABLE IF NOT EXISTS users (
-	uid  INTEGER PRIMARY KEY,
-	name TEXT UNIQUE
-);
-
-CREATE TABLE IF NOT EXISTS items (
-	id    INTEGER PRIMARY KEY,
-	uid   INTEGER NOT NULL,
-	name  TEXT,
-	type  TEXT,
-	value BIGINT
-);
-`
-)
+func (da DataAccessSQL) Ping(context context.Context) error {
+	return da.database.PingContext(context)
+}
+
+// Helper method to get what commands should run against,
+// the transaction we are part of if there is one
+func (da DataAccessSQL) runner() sqlRunner {
+	if da.tx != nil {
+		return da.tx
+	}
+	return da.database
+}
+
+// Helper method to start the transaction a method makes its changes in
+// Inside WithTransaction that is a savepoint, so the method still succeeds or fails as a whole
+// without ending the outer transaction
+func (da DataAccessSQL) begin(context context.Context) (sqlTransaction, error) {
+	if da.tx == nil {
+		return da.database.BeginTx(context, nil)
+	}
+
+	if _, err := da.tx.ExecContext(context, "SAVEPOINT "+savepointName); err != nil {
+		return nil, err
+	}
+	return &sqlSavepoint{Tx: da.tx, context: context}, nil
+}
+
+func (da DataAccessSQL) WithTransaction(context context.Context, work func(DataAccess) error) error {
+	// already inside one, so just join it
+	if da.tx != nil {
+		return work(da)
+	}
+
+	tx, err := da.database.BeginTx(context, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	inner := da
+	inner.tx = tx
+	if err := work(inner); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Rewrites a command's placeholders into the form the driver expects
+// Commands are written with $1, $2, ... each used once and in order,
+// so they can be swapped for ? placeholders one for one
+func (da DataAccessSQL) bind(command string) string {
+	if !da.dialect.positional {
+		return command
+	}
+	return placeholderPattern.ReplaceAllString(command, "?")
+}
 
 func (da DataAccessSQL) Standup(context context.Context) error {
-	// create the database & its tables if it does not exist
-	_, err := da.database.ExecContext(context, standupSchema)
-	return err
+	// create the database & its tables, or bring them up to date
+	return da.Migrate(context, latestMigration(da.dialect.migrations))
 }
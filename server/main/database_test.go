@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// MySQL is only tested when given a database to work in, everything in it is dropped first
+// The CI workflow runs one as a service, locally one can be started with
+//
+//	docker run -d --name worthtracker-mysql -p 3306:3306 -e MYSQL_ROOT_PASSWORD=worthtracker -e MYSQL_DATABASE=worthtracker_test mysql:8.0
+//	WORTHTRACKER_TEST_MYSQL_DSN='root:worthtracker@tcp(127.0.0.1:3306)/worthtracker_test' go test ./...
+const testMySQLEnv = "WORTHTRACKER_TEST_MYSQL_DSN"
+
+// Helper method to run a test against every engine which is available
+func forEachEngine(t *testing.T, test func(t *testing.T, da DataAccess)) {
+	t.Run(sqliteDialect.driver, func(t *testing.T) {
+		test(t, openTestDataAccess(t, sqliteDialect.driver, filepath.Join(t.TempDir(), "test.db"), false))
+	})
+	t.Run(mysqlDialect.driver, func(t *testing.T) {
+		dsn := os.Getenv(testMySQLEnv)
+		if dsn == "" {
+			t.Skip(testMySQLEnv + " is not set")
+		}
+		test(t, openTestDataAccess(t, mysqlDialect.driver, dsn, false))
+	})
+}
+
+// Helper method to open an empty database, migrated to the latest version unless bare is set
+func openTestDataAccess(t *testing.T, driver string, dsn string, bare bool) DataAccess {
+	t.Helper()
+	if driver == mysqlDialect.driver {
+		dropMySQLTables(t, dsn)
+	}
+
+	da, err := OpenDataAccess(driver, dsn)
+	if err != nil {
+		t.Fatalf("opening %s: %v", driver, err)
+	}
+	t.Cleanup(da.Close)
+
+	if !bare {
+		if err := da.Standup(context.Background()); err != nil {
+			t.Fatalf("standing up %s: %v", driver, err)
+		}
+	}
+	return da
+}
+
+// Helper method to empty the MySQL test database, so every test starts from nothing
+func dropMySQLTables(t *testing.T, dsn string) {
+	t.Helper()
+	database, err := sql.Open(mysqlDialect.driver, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	conn, err := database.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(context.Background(), "SELECT table_name FROM information_schema.tables WHERE table_schema = DATABASE()")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := make([]string, 0)
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+
+	conn.ExecContext(context.Background(), mysqlDialect.foreignKeysOff)
+	defer conn.ExecContext(context.Background(), mysqlDialect.foreignKeysOn)
+	for _, table := range tables {
+		if _, err := conn.ExecContext(context.Background(), "DROP TABLE `"+table+"`"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Helper method to add a user and find them again
+func addTestUser(t *testing.T, da DataAccess, name string) *UserEntry {
+	t.Helper()
+	if err := AddUser(context.Background(), da, name, "password123"); err != nil {
+		t.Fatalf("adding %s: %v", name, err)
+	}
+	user, err := da.FindUserByName(context.Background(), name)
+	if err != nil || user == nil {
+		t.Fatalf("finding %s: %v", name, err)
+	}
+	return user
+}
+
+func TestMigrationsReachLatest(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, da DataAccess) {
+		current, latest, err := da.GetSchemaVersion(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if current != latest {
+			t.Errorf("schema version %d, want %d", current, latest)
+		}
+
+		migrations, err := da.GetMigrations(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range *migrations {
+			if m.Applied == nil {
+				t.Errorf("migration %d was not applied", m.Version)
+			}
+		}
+
+		// standing up again has nothing left to do
+		if err := da.Standup(context.Background()); err != nil {
+			t.Errorf("second standup: %v", err)
+		}
+
+		var target *MigrationTargetError
+		if err := da.Migrate(context.Background(), 1); !errors.As(err, &target) {
+			t.Errorf("migrating down gave %v, want a MigrationTargetError", err)
+		}
+	})
+}
+
+func TestMigrationRecordsExistingItemValues(t *testing.T) {
+	da := openTestDataAccess(t, sqliteDialect.driver, filepath.Join(t.TempDir(), "test.db"), true)
+	if err := da.Migrate(context.Background(), 3); err != nil {
+		t.Fatal(err)
+	}
+
+	// an item from before there was any history
+	database := da.(DataAccessSQL).database
+	if _, err := database.Exec("INSERT INTO users (name) VALUES ('alice')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.Exec("INSERT INTO items (uid, name, type, value) VALUES (1, 'House', 'Asset', 500)"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := da.Standup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	history, err := da.GetItemHistory(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*history) != 1 || (*history)[0].Value != 500 {
+		t.Errorf("history %+v, want the one value 500", *history)
+	}
+}
+
+func TestUserNamesAreCaseSensitive(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, da DataAccess) {
+		upper := addTestUser(t, da, "Alice")
+		lower := addTestUser(t, da, "alice")
+		if upper.Id == lower.Id {
+			t.Fatal("Alice and alice are the same user")
+		}
+
+		found, err := da.FindUserByName(context.Background(), "alice")
+		if err != nil || found == nil || found.Id != lower.Id {
+			t.Errorf("found %+v for alice, want user %d", found, lower.Id)
+		}
+		if err := AddUser(context.Background(), da, "alice", "password123"); err == nil {
+			t.Error("added alice twice")
+		}
+	})
+}
+
+func TestItemNamesSortAndFilterAlike(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, da DataAccess) {
+		user := addTestUser(t, da, "alice")
+		for _, name := range []string{"cherry", "apple", "Banana", "Ærø house"} {
+			if _, err := da.AddItem(context.Background(), &ItemEntry{Uid: user.Id, Name: name, Type: ItemTypeAsset,
+				Category: ItemCategoryOther, Currency: DefaultCurrency, Value: 1}); err != nil {
+				t.Fatalf("adding %s: %v", name, err)
+			}
+		}
+
+		// names sort exactly, capitals first, the same on every engine
+		items, err := da.GetItemsByUser(context.Background(), user.Id, &ItemQuery{Sort: ItemSortName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, 0, len(*items))
+		for _, item := range *items {
+			names = append(names, item.Name)
+		}
+		if strings.Join(names, ",") != "Banana,apple,cherry,Ærø house" {
+			t.Errorf("sorted as %v", names)
+		}
+
+		// while the name filter still ignores case
+		items, err = da.GetItemsByUser(context.Background(), user.Id, &ItemQuery{Filter: ItemFilter{NameContains: "AN"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(*items) != 1 || (*items)[0].Name != "Banana" {
+			t.Errorf("filtered to %+v, want Banana", *items)
+		}
+	})
+}
+
+// Helper method to count every row of a table, whoever it belongs to
+func countTestRows(t *testing.T, da DataAccess, table string) int {
+	t.Helper()
+	var count int
+	if err := da.(DataAccessSQL).database.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+// The tables holding rows which belong to a user
+var userOwnedTables = []string{"items", "item_values", "item_tags", "snapshots", "snapshot_items", "sessions"}
+
+func TestUserUpdateAndDelete(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, da DataAccess) {
+		user := addTestUser(t, da, "alice")
+		user.DisplayName = "Alice A."
+		user.Locale = "en-GB"
+		user.FiscalYearStart = 4
+		if err := da.UpdateUser(context.Background(), user); err != nil {
+			t.Fatal(err)
+		}
+		found, err := da.FindUserById(context.Background(), user.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found.DisplayName != "Alice A." || found.Locale != "en-GB" || found.FiscalYearStart != 4 {
+			t.Errorf("profile not saved: %+v", found)
+		}
+
+		item, err := da.AddItem(context.Background(), &ItemEntry{Uid: user.Id, Name: "House", Type: ItemTypeAsset,
+			Category: ItemCategoryRealEstate, Currency: DefaultCurrency, Value: 500, Tags: []string{"home"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the user's items go with them
+		if err := da.DeleteUser(context.Background(), user.Id); err != nil {
+			t.Fatal(err)
+		}
+		if found, err := da.FindItemById(context.Background(), item.Id); err != nil || found != nil {
+			t.Errorf("item left behind: %+v, %v", found, err)
+		}
+		var missing *UserDoesNotExistError
+		if err := da.DeleteUser(context.Background(), user.Id); !errors.As(err, &missing) {
+			t.Errorf("deleting again gave %v, want a UserDoesNotExistError", err)
+		}
+	})
+}
+
+func TestItemCRUD(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, da DataAccess) {
+		user := addTestUser(t, da, "alice")
+		item, err := da.AddItem(context.Background(), &ItemEntry{Uid: user.Id, Name: "House", Type: ItemTypeAsset,
+			Category: ItemCategoryRealEstate, Currency: DefaultCurrency, Value: 500, Tags: []string{"Home", "home"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item.Version != 1 || len(item.Tags) != 2 {
+			t.Errorf("added %+v, want version 1 and both tags", item)
+		}
+
+		item.Value = 700
+		updated, err := da.UpdateItem(context.Background(), item)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated.Value != 700 || updated.Version != 2 {
+			t.Errorf("updated %+v, want value 700 at version 2", updated)
+		}
+
+		// the old version has been overwritten
+		var conflict *ItemVersionConflictError
+		if _, err := da.UpdateItem(context.Background(), item); !errors.As(err, &conflict) {
+			t.Errorf("stale update gave %v, want a conflict", err)
+		}
+
+		history, err := da.GetItemHistory(context.Background(), item.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(*history) != 2 || (*history)[0].Value != 500 || (*history)[1].Value != 700 {
+			t.Errorf("history %+v, want 500 then 700", *history)
+		}
+
+		items, err := da.GetItemsByUser(context.Background(), user.Id, &ItemQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(*items) != 1 {
+			t.Errorf("listed %d items, want 1", len(*items))
+		}
+
+		if err := da.DeleteItem(context.Background(), item.Id, 1); !errors.As(err, &conflict) {
+			t.Errorf("stale delete gave %v, want a conflict", err)
+		}
+		if err := da.DeleteItem(context.Background(), item.Id, 2); err != nil {
+			t.Fatal(err)
+		}
+		if found, err := da.FindItemById(context.Background(), item.Id); err != nil || found != nil {
+			t.Errorf("deleted item still found: %+v, %v", found, err)
+		}
+	})
+}
+
+func TestTransactionRollsBack(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, da DataAccess) {
+		user := addTestUser(t, da, "alice")
+		failure := errors.New("stop")
+		err := da.WithTransaction(context.Background(), func(tx DataAccess) error {
+			if _, err := tx.AddItem(context.Background(), &ItemEntry{Uid: user.Id, Name: "House", Type: ItemTypeAsset,
+				Category: ItemCategoryOther, Currency: DefaultCurrency, Value: 1}); err != nil {
+				return err
+			}
+			return failure
+		})
+		if err != failure {
+			t.Fatalf("transaction gave %v", err)
+		}
+
+		items, err := da.GetItemsByUser(context.Background(), user.Id, &ItemQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(*items) != 0 {
+			t.Errorf("%d items kept after rolling back", len(*items))
+		}
+	})
+}
+
+func TestDeleteUserWithoutForeignKeys(t *testing.T) {
+	// an endpoint can switch sqlite's enforcement off, which mustn't leave anything behind
+	// migrating switches it back on for its connection, so a fresh one is opened after
+	dsn := filepath.Join(t.TempDir(), "test.db") + "?_foreign_keys=0"
+	openTestDataAccess(t, sqliteDialect.driver, dsn, false).Close()
+	da := openTestDataAccess(t, sqliteDialect.driver, dsn, true)
+	user := addTestUser(t, da, "alice")
+	if _, err := da.AddItem(context.Background(), &ItemEntry{Uid: user.Id, Name: "House", Type: ItemTypeAsset,
+		Category: ItemCategoryRealEstate, Currency: DefaultCurrency, Value: 500, Tags: []string{"home"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TakeSnapshot(context.Background(), da, user); err != nil {
+		t.Fatal(err)
+	}
+	if err := da.AddSession(context.Background(), hashSessionToken("token"), user.Id, time.Now().Add(time.Hour).Unix()); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range userOwnedTables {
+		if countTestRows(t, da, table) == 0 {
+			t.Fatalf("nothing was added to %s", table)
+		}
+	}
+
+	if err := da.DeleteUser(context.Background(), user.Id); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range append(userOwnedTables, "users") {
+		if count := countTestRows(t, da, table); count != 0 {
+			t.Errorf("%d rows left behind in %s", count, table)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// bump this whenever the shape of ExportDocument changes
+	exportVersion    = 1
+	exportFormatCSV  = "csv"
+	exportFormatJSON = "json"
+	// spreadsheets read a cell starting with one of these as a formula
+	csvFormulaPrefixes = "=+-@"
+	// and a cell starting with this as text, the quote itself isn't shown
+	csvTextPrefix = "'"
+)
+
+type exportHandlers struct {
+	da DataAccess
+}
+
+// Everything we hold for one user, in a form the import can read back
+type ExportDocument struct {
+	Version      int
+	Exported     time.Time
+	Username     string
+	BaseCurrency string
+	Items        []ExportItem
+	Snapshots    []SnapshotEntry
+}
+
+// An item with its valuation history, oldest first
+// Id is the item's id on the instance it was exported from, which snapshot items refer to
+type ExportItem struct {
+	Id       int
+	Name     string
+	Type     string
+	Category string
+	Currency string
+	Value    int64
+	Tags     []string
+	History  []ItemValueEntry
+}
+
+type InvalidExportFormatError struct {
+	Format string
+}
+
+func (err *InvalidExportFormatError) Error() string {
+	return "'" + err.Format + "' is an invalid export format: Must be '" + exportFormatCSV + "' or '" + exportFormatJSON + "'."
+}
+
+// Formats hundredths as a decimal amount, the inverse of parseAmount
+func formatAmount(value int64) string {
+	sign := ""
+	if value < 0 {
+		sign = "-"
+	}
+	// avoid overflowing when negating the smallest int64
+	whole := uint64(value)
+	if value < 0 {
+		whole = uint64(-(value + 1)) + 1
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, whole/100, whole%100)
+}
+
+// Gathers all of a user's items, their history and their snapshots
+// They are read in one transaction, so changes made meanwhile are in all of the export or none of it
+func ExportUserData(context context.Context, da DataAccess, user *UserEntry) (*ExportDocument, error) {
+	document := ExportDocument{Version: exportVersion, Exported: time.Now().UTC().Truncate(time.Second), Username: user.Name,
+		BaseCurrency: user.BaseCurrency}
+	err := da.WithTransaction(context, func(tx DataAccess) error {
+		items, err := tx.GetItemsByUser(context, user.Id, nil)
+		if err != nil {
+			return err
+		}
+
+		document.Items = make([]ExportItem, 0, len(*items))
+		for _, item := range *items {
+			history, err := tx.GetItemHistory(context, item.Id)
+			if err != nil {
+				return err
+			}
+
+			tags := item.Tags
+			if tags == nil {
+				tags = make([]string, 0)
+			}
+			document.Items = append(document.Items, ExportItem{Id: item.Id, Name: item.Name, Type: item.Type, Category: item.Category,
+				Currency: item.Currency, Value: item.Value, Tags: tags, History: *history})
+		}
+
+		// every snapshot the user has ever taken
+		snapshots, err := tx.GetSnapshotsByUser(context, user.Id, time.Unix(0, 0), time.Time{})
+		if err != nil {
+			return err
+		}
+		document.Snapshots = *snapshots
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &document, nil
+}
+
+// Helper method to keep a cell of free text from being run as a formula when the file is opened
+// in a spreadsheet, a cell already starting with the text marker is marked again so the import can
+// tell the two apart, see unescapeCSVCell
+func escapeCSVCell(cell string) string {
+	if cell != "" && strings.ContainsAny(cell[:1], csvFormulaPrefixes+csvTextPrefix) {
+		return csvTextPrefix + cell
+	}
+	return cell
+}
+
+// Writes the items of an export as CSV, in the same layout ImportItems reads
+// History and snapshots do not fit in a flat file and are left out
+// Names and tags are the only free text, so only they are escaped
+func writeExportCSV(writer io.Writer, document *ExportDocument) error {
+	csvWriter := csv.NewWriter(writer)
+	if err := csvWriter.Write([]string{"name", "type", "value", "category", "currency", "tags"}); err != nil {
+		return err
+	}
+
+	for _, item := range document.Items {
+		record := []string{escapeCSVCell(item.Name), item.Type, formatAmount(item.Value), item.Category, item.Currency,
+			escapeCSVCell(strings.Join(item.Tags, importTagSeparator))}
+		if err := csvWriter.Write(record); err != nil {
+			return err
+		}
+	}
+
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// Handles the incoming http requests to export the user's data
+// A "format" query parameter picks csv or json, json being the default
+func (eh exportHandlers) ExportRequestHandler(writer http.ResponseWriter, request *http.Request) {
+	writeAPIHeaders(writer, request)
+
+	switch request.Method {
+	case http.MethodOptions:
+		return
+	case http.MethodGet:
+		format := strings.ToLower(request.URL.Query().Get("format"))
+		if format == "" {
+			format = exportFormatJSON
+		}
+		if format != exportFormatCSV && format != exportFormatJSON {
+			err := &InvalidExportFormatError{Format: format}
+			writeError(writer, request, err)
+			return
+		}
+
+		user := requestUser(request)
+		document, err := ExportUserData(request.Context(), eh.da, user)
+		if err != nil {
+			logWarn(request.Context(), "Failed to export user data", errorField(err))
+			writeError(writer, request, err)
+			return
+		}
+
+		// offer the export as a download
+		filename := "worthtracker-" + strconv.Itoa(user.Id) + "-" + document.Exported.Format(dateLayout) + "." + format
+		writer.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
+
+		if format == exportFormatCSV {
+			writer.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			if err := writeExportCSV(writer, document); err != nil {
+				logError(request.Context(), "Failed to write export", errorField(err))
+			}
+			return
+		}
+		json.NewEncoder(writer).Encode(document)
+	default:
+		writeError(writer, request, &MethodNotAllowedError{Method: request.Method})
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Helper method to export everything the client's user has
+func exportTestData(client *testClient) *ExportDocument {
+	client.t.Helper()
+	var document ExportDocument
+	decodeTestBody(client.t, client.expect(http.MethodGet, "/api/export", nil, http.StatusOK), &document)
+	return &document
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.login(t, "alice")
+	var change ItemChange
+	decodeTestBody(t, alice.expect(http.MethodPost, "/api/item", map[string]interface{}{"Name": "House", "ItemType": ItemTypeAsset,
+		"Category": ItemCategoryRealEstate, "Value": 500, "Tags": []string{"home", "Property"}}, http.StatusOK), &change)
+	alice.expect(http.MethodPut, "/api/item", map[string]interface{}{"Id": change.Item.Id, "Name": "House", "ItemType": ItemTypeAsset,
+		"Category": ItemCategoryRealEstate, "Value": 650, "Tags": []string{"home", "Property"}, "Version": 1}, http.StatusOK)
+	addTestItem(alice, "Car", 200)
+	alice.expect(http.MethodPost, "/api/snapshot", nil, http.StatusOK)
+
+	// snapshots from after 2038 are exported like any other
+	late := SnapshotEntry{Uid: change.Item.Uid, Taken: time.Date(2040, 1, 1, 0, 0, 0, 0, time.UTC), Currency: DefaultCurrency,
+		NetWorth: 650, AssetTotal: 650, Items: []SnapshotItemEntry{{ItemId: change.Item.Id, Name: "House", Type: ItemTypeAsset, Value: 650}}}
+	if _, err := api.da.AddSnapshot(context.Background(), &late); err != nil {
+		t.Fatal(err)
+	}
+
+	exported := exportTestData(alice)
+	if len(exported.Items) != 2 || len(exported.Snapshots) != 2 {
+		t.Fatalf("exported %d items and %d snapshots, want 2 and 2", len(exported.Items), len(exported.Snapshots))
+	}
+
+	bob := api.login(t, "bob")
+	var result ImportResult
+	decodeTestBody(t, bob.expect(http.MethodPost, "/api/itemimport", exported, http.StatusOK, "Content-Type", "application/json"), &result)
+	if result.Imported != 2 || result.ImportedSnapshots != 2 || len(result.Errors) != 0 {
+		t.Fatalf("import gave %+v, want everything imported", result)
+	}
+
+	// bob now holds the same data, under new ids
+	imported := exportTestData(bob)
+	newIds := make(map[int]int)
+	for i := range exported.Items {
+		before, after := exported.Items[i], imported.Items[i]
+		newIds[before.Id] = after.Id
+		before.Id, after.Id = 0, 0
+		for j := range before.History {
+			before.History[j].ItemId = 0
+		}
+		for j := range after.History {
+			after.History[j].ItemId = 0
+		}
+		if !reflect.DeepEqual(before, after) {
+			t.Errorf("item came back as %+v, want %+v", after, before)
+		}
+	}
+	for i := range exported.Snapshots {
+		before, after := exported.Snapshots[i], imported.Snapshots[i]
+		for j := range before.Items {
+			before.Items[j].ItemId = newIds[before.Items[j].ItemId]
+		}
+		before.Id, after.Id, before.Uid, after.Uid = 0, 0, 0, 0
+		if !reflect.DeepEqual(before, after) {
+			t.Errorf("snapshot came back as %+v, want %+v", after, before)
+		}
+	}
+}
+
+func TestCSVExportImportRoundTrip(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.login(t, "alice")
+	alice.expect(http.MethodPost, "/api/item", map[string]interface{}{"Name": "House, with garden", "ItemType": ItemTypeAsset,
+		"Category": ItemCategoryRealEstate, "Value": 50099, "Tags": []string{"home", "Property"}}, http.StatusOK)
+	addTestItem(alice, "Loan", 200)
+
+	file := alice.expect(http.MethodGet, "/api/export?format=csv", nil, http.StatusOK)
+	bob := api.login(t, "bob")
+	var result ImportResult
+	decodeTestBody(t, bob.expect(http.MethodPost, "/api/itemimport", string(file), http.StatusOK, "Content-Type", "text/csv"), &result)
+	if result.Imported != 2 || len(result.Errors) != 0 {
+		t.Fatalf("import gave %+v, want both items", result)
+	}
+
+	exported, imported := exportTestData(alice), exportTestData(bob)
+	for i := range exported.Items {
+		before, after := exported.Items[i], imported.Items[i]
+		if before.Name != after.Name || before.Type != after.Type || before.Category != after.Category ||
+			before.Currency != after.Currency || before.Value != after.Value || !reflect.DeepEqual(before.Tags, after.Tags) {
+			t.Errorf("item came back as %+v, want %+v", after, before)
+		}
+	}
+}
+
+func TestCSVExportEscapesFormulas(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.login(t, "alice")
+	names := []string{"=HYPERLINK(\"http://evil.example\")", "+1 fund", "-5 debt", "@SUM(A1)", "'quoted", "Cash"}
+	for _, name := range names {
+		alice.expect(http.MethodPost, "/api/item", map[string]interface{}{"Name": name, "ItemType": ItemTypeAsset,
+			"Value": 100, "Tags": []string{"=cmd|' /C calc'!A0", "ok"}}, http.StatusOK)
+	}
+
+	file := alice.expect(http.MethodGet, "/api/export?format=csv", nil, http.StatusOK)
+	records, err := csv.NewReader(bytes.NewReader(file)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records[1:] {
+		for _, cell := range []string{record[0], record[5]} {
+			if strings.ContainsAny(cell[:1], csvFormulaPrefixes) {
+				t.Errorf("cell %q would be run as a formula", cell)
+			}
+		}
+	}
+	if records[1][0] != `'=HYPERLINK("http://evil.example")` || records[5][0] != "''quoted" || records[6][0] != "Cash" {
+		t.Errorf("names were written as %q, %q and %q", records[1][0], records[5][0], records[6][0])
+	}
+
+	// the import reads back what was there before escaping
+	bob := api.login(t, "bob")
+	bob.expect(http.MethodPost, "/api/itemimport", string(file), http.StatusOK, "Content-Type", "text/csv")
+	imported := exportTestData(bob)
+	for i, item := range imported.Items {
+		if item.Name != names[i] || !reflect.DeepEqual(item.Tags, []string{"=cmd|' /C calc'!A0", "ok"}) {
+			t.Errorf("item came back as %q with tags %q", item.Name, item.Tags)
+		}
+	}
+}
+
+func TestExportReadsInOneTransaction(t *testing.T) {
+	da := openTestDataAccess(t, sqliteDialect.driver, filepath.Join(t.TempDir(), "test.db"), false)
+	user := addTestUser(t, da, "alice")
+	if _, err := AddItem(context.Background(), da, user, &ItemEntry{Name: "House", Type: ItemTypeAsset, Value: 500}); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := NewServerMetrics()
+	if _, err := ExportUserData(context.Background(), InstrumentDataAccess(da, metrics), user); err != nil {
+		t.Fatal(err)
+	}
+	if testMetricCount(metrics.dbLatency, "WithTransaction") != 1 || testMetricCount(metrics.dbLatency, "GetItemHistory") != 1 {
+		t.Error("the export was not read in a single transaction")
+	}
+}
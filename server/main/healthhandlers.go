@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"strconv"
+)
+
+// Filled in when building a release, e.g.
+// go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%FT%TZ)"
+var (
+	version   = "dev"
+	commit    = ""
+	buildTime = ""
+)
+
+type healthHandlers struct {
+	da DataAccess
+}
+
+// The body of a health or readiness check which passed
+type HealthStatus struct {
+	Status string
+	// the schema version the database is at, readiness only
+	SchemaVersion int `json:",omitempty"`
+}
+
+type VersionInfo struct {
+	Version   string
+	Commit    string `json:",omitempty"`
+	Built     string `json:",omitempty"`
+	GoVersion string
+}
+
+type NotReadyError struct {
+	Reason string
+	// what went wrong with the database, which is logged but never sent as it can name hosts
+	cause error
+}
+
+func (err *NotReadyError) Error() string {
+	return "Not ready to serve requests: " + err.Reason
+}
+
+// Checks that the database can be reached and has every migration this build expects
+func CheckReady(context context.Context, da DataAccess) (*HealthStatus, error) {
+	if err := da.Ping(context); err != nil {
+		return nil, &NotReadyError{Reason: "The database is unavailable.", cause: err}
+	}
+
+	current, latest, err := da.GetSchemaVersion(context)
+	if err != nil {
+		return nil, &NotReadyError{Reason: "The database is unavailable.", cause: err}
+	} else if current != latest {
+		return nil, &NotReadyError{Reason: "The database is at schema version " + strconv.Itoa(current) +
+			" but this build expects version " + strconv.Itoa(latest) + "."}
+	}
+
+	return &HealthStatus{Status: "ready", SchemaVersion: current}, nil
+}
+
+// Helper method to only allow the methods a probe would use
+func probeMethodAllowed(writer http.ResponseWriter, request *http.Request) bool {
+	if request.Method == http.MethodGet || request.Method == http.MethodHead {
+		return true
+	}
+	writer.Header().Set("Allow", "GET, HEAD")
+	writeError(writer, request, &MethodNotAllowedError{Method: request.Method})
+	return false
+}
+
+// Handles liveness checks, the process is up if it can answer at all
+func (hh healthHandlers) HealthRequestHandler(writer http.ResponseWriter, request *http.Request) {
+	if !probeMethodAllowed(writer, request) {
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(writer).Encode(HealthStatus{Status: "ok"})
+}
+
+// Handles readiness checks, responding 503 while requests can't be served
+func (hh healthHandlers) ReadyRequestHandler(writer http.ResponseWriter, request *http.Request) {
+	if !probeMethodAllowed(writer, request) {
+		return
+	}
+
+	writer.Header().Set("Cache-Control", "no-store")
+	status, err := CheckReady(request.Context(), hh.da)
+	if err != nil {
+		// the database's own error stays in our logs, it can name the host and user
+		if notReady, ok := err.(*NotReadyError); ok && notReady.cause != nil {
+			logWarn(request.Context(), "Database unavailable for readiness check", errorField(notReady.cause))
+		} else {
+			// probes fail repeatedly while migrations are pending, so keep it out of the usual logs
+			logDebug(request.Context(), "Not ready", errorField(err))
+		}
+		writeError(writer, request, err)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(status)
+}
+
+// Handles requests for what build of the server is running
+func (hh healthHandlers) VersionRequestHandler(writer http.ResponseWriter, request *http.Request) {
+	if !probeMethodAllowed(writer, request) {
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(VersionInfo{Version: version, Commit: commit, Built: buildTime,
+		GoVersion: runtime.Version()})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// Helper method to send a probe straight to a health handler
+func probeTestHealth(handler http.HandlerFunc, method string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(method, "/", nil))
+	return recorder
+}
+
+func TestReadyOnceMigrated(t *testing.T) {
+	da := openTestDataAccess(t, sqliteDialect.driver, filepath.Join(t.TempDir(), "test.db"), false)
+	recorder := probeTestHealth(healthHandlers{da: da}.ReadyRequestHandler, http.MethodGet)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("readiness gave %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var status HealthStatus
+	decodeTestBody(t, recorder.Body.Bytes(), &status)
+	if status.Status != "ready" || status.SchemaVersion != latestMigration(sqliteDialect.migrations) {
+		t.Errorf("readiness gave %+v", status)
+	}
+}
+
+func TestNotReadyWhileMigrationsArePending(t *testing.T) {
+	da := openTestDataAccess(t, sqliteDialect.driver, filepath.Join(t.TempDir(), "test.db"), true)
+	latest := latestMigration(sqliteDialect.migrations)
+	if err := da.Migrate(context.Background(), latest-1); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := probeTestHealth(healthHandlers{da: da}.ReadyRequestHandler, http.MethodGet)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("readiness behind the schema gave %d: %s", recorder.Code, recorder.Body.String())
+	}
+	expectErrorCode(t, recorder.Body.Bytes(), "not_ready")
+
+	// and ready again once it catches up
+	if err := da.Standup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if recorder := probeTestHealth(healthHandlers{da: da}.ReadyRequestHandler, http.MethodGet); recorder.Code != http.StatusOK {
+		t.Errorf("readiness after migrating gave %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestNotReadyWithoutTheDatabase(t *testing.T) {
+	da := openTestDataAccess(t, sqliteDialect.driver, filepath.Join(t.TempDir(), "test.db"), false)
+	da.Close()
+
+	recorder := probeTestHealth(healthHandlers{da: da}.ReadyRequestHandler, http.MethodGet)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("readiness without a database gave %d: %s", recorder.Code, recorder.Body.String())
+	}
+	expectErrorCode(t, recorder.Body.Bytes(), "not_ready")
+	// the driver's error can name hosts and users, so it is only logged
+	if body := recorder.Body.String(); strings.Contains(body, "sql:") || strings.Contains(body, "closed") {
+		t.Errorf("readiness shared the driver's error: %s", body)
+	}
+
+	// liveness doesn't depend on the database
+	if recorder := probeTestHealth(healthHandlers{da: da}.HealthRequestHandler, http.MethodGet); recorder.Code != http.StatusOK {
+		t.Errorf("liveness without a database gave %d", recorder.Code)
+	}
+}
+
+func TestVersionReportsTheBuild(t *testing.T) {
+	savedVersion, savedCommit, savedBuildTime := version, commit, buildTime
+	defer func() { version, commit, buildTime = savedVersion, savedCommit, savedBuildTime }()
+	version, commit, buildTime = "1.2.0", "abc123", "2024-01-02T03:04:05Z"
+
+	handler := healthHandlers{}.VersionRequestHandler
+	recorder := probeTestHealth(handler, http.MethodGet)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("version gave %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var info VersionInfo
+	decodeTestBody(t, recorder.Body.Bytes(), &info)
+	if info != (VersionInfo{Version: "1.2.0", Commit: "abc123", Built: "2024-01-02T03:04:05Z", GoVersion: runtime.Version()}) {
+		t.Errorf("version gave %+v", info)
+	}
+
+	if recorder := probeTestHealth(handler, http.MethodHead); recorder.Code != http.StatusOK {
+		t.Errorf("HEAD gave %d", recorder.Code)
+	}
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete} {
+		recorder := probeTestHealth(handler, method)
+		if recorder.Code != http.StatusMethodNotAllowed || recorder.Header().Get("Allow") != "GET, HEAD" {
+			t.Errorf("%s gave %d with Allow %q", method, recorder.Code, recorder.Header().Get("Allow"))
+		}
+		expectErrorCode(t, recorder.Body.Bytes(), "method_not_allowed")
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// the largest file the import endpoint will read
+	maxImportSize = 10 << 20
+	// tags share one CSV column, split by this
+	importTagSeparator = ";"
+)
+
+type importHandlers struct {
+	da DataAccess
+}
+
+// A problem with one row of an import, the line of a CSV file
+// or the position of the item in a JSON export
+type ImportRowError struct {
+	Line  int
+	Error string
+}
+
+type ImportResult struct {
+	Imported int
+	// only set when importing a JSON export
+	ImportedSnapshots int `json:",omitempty"`
+	// rows which could not be imported, in strict mode nothing is imported if there are any
+	Errors []ImportRowError
+}
+
+type InvalidImportError struct {
+	Reason string
+}
+
+func (err *InvalidImportError) Error() string {
+	return "Invalid import: " + err.Reason
+}
+
+type InvalidAmountError struct {
+	Value string
+}
+
+func (err *InvalidAmountError) Error() string {
+	return err.Value + " is an invalid amount: Must be a number with at most two decimal places."
+}
+
+// Parses a decimal amount such as 1234.56 into hundredths, the unit item values are stored in
+func parseAmount(value string) (int64, error) {
+	trimmed := strings.TrimSpace(value)
+	whole, fraction := trimmed, ""
+	if point := strings.Index(trimmed, "."); point >= 0 {
+		whole, fraction = trimmed[:point], trimmed[point+1:]
+	}
+	if len(fraction) > 2 || whole == "" || whole == "-" {
+		return 0, &InvalidAmountError{Value: value}
+	}
+	for _, digit := range fraction {
+		if digit < '0' || digit > '9' {
+			return 0, &InvalidAmountError{Value: value}
+		}
+	}
+
+	// pad the fraction out to hundredths and read the whole thing as one integer
+	parsed, err := strconv.ParseInt(whole+fraction+strings.Repeat("0", 2-len(fraction)), 10, 64)
+	if err != nil {
+		return 0, &InvalidAmountError{Value: value}
+	}
+	return parsed, nil
+}
+
+// Helper method to map the header row of an import to column indexes
+func readImportHeader(header []string) (map[string]int, error) {
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "name", "type", "value", "category", "currency", "tags":
+			columns[name] = i
+		default:
+			return nil, &InvalidImportError{Reason: "Unknown column '" + name + "'."}
+		}
+	}
+
+	for _, required := range []string{"name", "type", "value"} {
+		if _, ok := columns[required]; !ok {
+			return nil, &InvalidImportError{Reason: "The header must include a '" + required + "' column."}
+		}
+	}
+	return columns, nil
+}
+
+// Reads items from a CSV file whose header row names its columns: name, type
+// and value are required, category, currency and tags are optional
+// Every valid row is added in a single transaction; in strict mode
+// nothing is added unless every row is valid
+func ImportItems(context context.Context, da DataAccess, user *UserEntry, reader io.Reader, strict bool) (*ImportResult, error) {
+	csvReader := csv.NewReader(reader)
+	// rows with the wrong number of fields are reported per row, not for the whole file
+	csvReader.FieldsPerRecord = -1
+
+	header, err := csvReader.Read()
+	if err == io.EOF {
+		return nil, &InvalidImportError{Reason: "The file is empty."}
+	} else if err != nil {
+		return nil, &InvalidImportError{Reason: err.Error()}
+	}
+	columns, err := readImportHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	result := ImportResult{Errors: make([]ImportRowError, 0)}
+	items := make([]ItemEntry, 0)
+	for line := 2; ; line++ {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, &InvalidImportError{Reason: err.Error()}
+		}
+
+		item, err := readImportRow(columns, record, user)
+		if err != nil {
+			result.Errors = append(result.Errors, ImportRowError{Line: line, Error: err.Error()})
+			continue
+		}
+		items = append(items, *item)
+	}
+
+	if strict && len(result.Errors) > 0 {
+		return &result, nil
+	}
+
+	if len(items) > 0 {
+		if err := da.AddItems(context, &items); err != nil {
+			return nil, err
+		}
+	}
+	result.Imported = len(items)
+	return &result, nil
+}
+
+// Helper method to undo escapeCSVCell, a text marker is only dropped when the export would have added it
+func unescapeCSVCell(cell string) string {
+	if len(cell) > 1 && strings.HasPrefix(cell, csvTextPrefix) && strings.ContainsAny(cell[1:2], csvFormulaPrefixes+csvTextPrefix) {
+		return cell[1:]
+	}
+	return cell
+}
+
+// Helper method to turn one row of an import into a validated item
+func readImportRow(columns map[string]int, record []string, user *UserEntry) (*ItemEntry, error) {
+	if len(record) != len(columns) {
+		return nil, &InvalidImportError{Reason: fmt.Sprintf("Expected %d fields but found %d.", len(columns), len(record))}
+	}
+
+	value, err := parseAmount(record[columns["value"]])
+	if err != nil {
+		return nil, err
+	}
+
+	item := ItemEntry{
+		Uid:      user.Id,
+		Name:     strings.TrimSpace(unescapeCSVCell(record[columns["name"]])),
+		Type:     strings.TrimSpace(record[columns["type"]]),
+		Value:    value,
+		Currency: user.BaseCurrency,
+	}
+	if i, ok := columns["category"]; ok {
+		item.Category = strings.TrimSpace(record[i])
+	}
+	if i, ok := columns["currency"]; ok && strings.TrimSpace(record[i]) != "" {
+		item.Currency = record[i]
+	}
+	if i, ok := columns["tags"]; ok {
+		item.Tags = strings.Split(unescapeCSVCell(record[i]), importTagSeparator)
+	}
+
+	// run standard validation
+	normalizeItem(&item)
+	if err := validateItem(&item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// Reads a JSON export (see ExportUserData) and adds its items, with their
+// history, and its snapshots to the user
+// Invalid items are reported by their position; in strict mode nothing
+// is added unless every item is valid
+// A snapshot which is invalid fails the whole import, and the items and
+// snapshots are added together or not at all
+func ImportDocument(context context.Context, da DataAccess, user *UserEntry, reader io.Reader, strict bool) (*ImportResult, error) {
+	var document ExportDocument
+	if err := json.NewDecoder(reader).Decode(&document); err != nil {
+		return nil, &InvalidImportError{Reason: err.Error()}
+	}
+	if document.Version != exportVersion {
+		return nil, &InvalidImportError{Reason: fmt.Sprintf("Unsupported export version %d, expected %d.", document.Version, exportVersion)}
+	}
+
+	result := ImportResult{Errors: make([]ImportRowError, 0)}
+	items := make([]ItemEntry, 0, len(document.Items))
+	exportedIds := make([]int, 0, len(document.Items))
+	for i := range document.Items {
+		item, err := readImportItem(&document.Items[i], user)
+		if err != nil {
+			result.Errors = append(result.Errors, ImportRowError{Line: i + 1, Error: err.Error()})
+			continue
+		}
+		items = append(items, *item)
+		exportedIds = append(exportedIds, document.Items[i].Id)
+	}
+
+	// check the snapshots before anything is written
+	snapshots := document.Snapshots
+	for i := range snapshots {
+		currency, err := normalizeCurrency(snapshots[i].Currency)
+		if err != nil {
+			return nil, &InvalidImportError{Reason: fmt.Sprintf("Snapshot %d: %s", i+1, err.Error())}
+		}
+		snapshots[i].Uid = user.Id
+		snapshots[i].Currency = currency
+	}
+
+	if strict && len(result.Errors) > 0 {
+		return &result, nil
+	}
+
+	err := da.WithTransaction(context, func(tx DataAccess) error {
+		if len(items) > 0 {
+			if err := tx.AddItems(context, &items); err != nil {
+				return err
+			}
+		}
+
+		// point the snapshots at the new ids, items which were not imported are dropped to 0
+		newIds := make(map[int]int)
+		for i := range items {
+			newIds[exportedIds[i]] = items[i].Id
+		}
+		for i := range snapshots {
+			for j := range snapshots[i].Items {
+				snapshots[i].Items[j].ItemId = newIds[snapshots[i].Items[j].ItemId]
+			}
+			if _, err := tx.AddSnapshot(context, &snapshots[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result.Imported = len(items)
+	result.ImportedSnapshots = len(snapshots)
+	return &result, nil
+}
+
+// Helper method to turn one exported item into a validated item to add
+func readImportItem(exported *ExportItem, user *UserEntry) (*ItemEntry, error) {
+	item := ItemEntry{
+		Uid:      user.Id,
+		Name:     exported.Name,
+		Type:     exported.Type,
+		Category: exported.Category,
+		Currency: exported.Currency,
+		Value:    exported.Value,
+		Tags:     exported.Tags,
+	}
+
+	// run standard validation
+	normalizeItem(&item)
+	if err := validateItem(&item); err != nil {
+		return nil, err
+	}
+
+	// the history has to end at the current value, so record it now if it doesn't
+	history := append([]ItemValueEntry(nil), exported.History...)
+	sort.SliceStable(history, func(i, j int) bool { return history[i].Recorded.Before(history[j].Recorded) })
+	for _, value := range history {
+		if value.Value < 0 {
+			return nil, &InvalidItemValueError{Reason: "Every value in the history must not be negative."}
+		}
+	}
+	if len(history) == 0 || history[len(history)-1].Value != item.Value {
+		history = append(history, ItemValueEntry{Value: item.Value, Recorded: time.Now()})
+	}
+	item.History = history
+
+	return &item, nil
+}
+
+// Handles the incoming http requests to import items from a CSV file or JSON export
+// The file is either the request body or a multipart "file" field, a JSON
+// body is read as an export, and a "strict" query parameter of true turns
+// on strict mode
+func (ih importHandlers) ItemImportRequestHandler(writer http.ResponseWriter, request *http.Request) {
+	writeAPIHeaders(writer, request)
+
+	switch request.Method {
+	case http.MethodOptions:
+		return
+	case http.MethodPost:
+		strict := false
+		if value := request.URL.Query().Get("strict"); value != "" {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				writeError(writer, request, &InvalidRequestError{Field: "strict", Reason: "Must be true or false."})
+				return
+			}
+			strict = parsed
+		}
+
+		// accept either a form upload or the raw file
+		request.Body = http.MaxBytesReader(writer, request.Body, maxImportSize)
+		var file io.Reader = request.Body
+		if strings.HasPrefix(request.Header.Get("Content-Type"), "multipart/form-data") {
+			formFile, _, err := request.FormFile("file")
+			if err != nil {
+				writeError(writer, request, &InvalidRequestError{Field: "file", Reason: err.Error()})
+				return
+			}
+			defer formFile.Close()
+			file = formFile
+		}
+
+		importer := ImportItems
+		if strings.HasPrefix(request.Header.Get("Content-Type"), "application/json") {
+			importer = ImportDocument
+		}
+
+		result, err := importer(request.Context(), ih.da, requestUser(request), file, strict)
+		if err != nil {
+			logWarn(request.Context(), "Failed to import items", errorField(err))
+			writeError(writer, request, err)
+			return
+		}
+
+		// a strict import with errors added nothing
+		if strict && len(result.Errors) > 0 {
+			writer.WriteHeader(http.StatusBadRequest)
+		}
+		json.NewEncoder(writer).Encode(result)
+	default:
+		writeError(writer, request, &MethodNotAllowedError{Method: request.Method})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Helper method to count the items the client's user has
+func countTestItems(client *testClient) int {
+	client.t.Helper()
+	var list ItemList
+	decodeTestBody(client.t, client.expect(http.MethodPost, "/api/itemlist", nil, http.StatusOK), &list)
+	return list.Count
+}
+
+func TestCSVImport(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.login(t, "alice")
+	file := "name,type,value,tags\nHouse,Asset,1500.50,home;property\nX,Asset,10,\nLoan,Liability,200,\n"
+
+	// strict mode adds nothing while any row is invalid
+	var result ImportResult
+	decodeTestBody(t, alice.expect(http.MethodPost, "/api/itemimport?strict=true", file, http.StatusBadRequest, "Content-Type", "text/csv"), &result)
+	if result.Imported != 0 || len(result.Errors) != 1 || result.Errors[0].Line != 3 {
+		t.Errorf("strict import gave %+v, want only line 3 reported", result)
+	}
+	if count := countTestItems(alice); count != 0 {
+		t.Errorf("strict import added %d items", count)
+	}
+
+	// otherwise the valid rows go in
+	result = ImportResult{}
+	decodeTestBody(t, alice.expect(http.MethodPost, "/api/itemimport", file, http.StatusOK, "Content-Type", "text/csv"), &result)
+	if result.Imported != 2 || len(result.Errors) != 1 {
+		t.Errorf("import gave %+v, want 2 imported and 1 error", result)
+	}
+	if count := countTestItems(alice); count != 2 {
+		t.Errorf("%d items after importing, want 2", count)
+	}
+}
+
+func TestDocumentImportIsAllOrNothing(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.login(t, "alice")
+
+	// the snapshot comes after a valid item, which must not be added without it
+	document := `{"Version": 1, "Items": [{"Id": 7, "Name": "House", "Type": "Asset", "Currency": "USD", "Value": 500}],
+		"Snapshots": [{"Currency": "not a currency", "NetWorth": 500, "Items": [{"ItemId": 7, "Value": 500}]}]}`
+	content := alice.expect(http.MethodPost, "/api/itemimport", document, http.StatusBadRequest, "Content-Type", "application/json")
+	expectErrorCode(t, content, "invalid_import")
+	if count := countTestItems(alice); count != 0 {
+		t.Errorf("failed import added %d items", count)
+	}
+
+	document = strings.Replace(document, "not a currency", "USD", 1)
+	var result ImportResult
+	decodeTestBody(t, alice.expect(http.MethodPost, "/api/itemimport", document, http.StatusOK, "Content-Type", "application/json"), &result)
+	if result.Imported != 1 || result.ImportedSnapshots != 1 {
+		t.Errorf("import gave %+v, want 1 item and 1 snapshot", result)
+	}
+}
+
+func TestDocumentImportRejectsNegativeHistory(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.login(t, "alice")
+
+	document := `{"Version": 1, "Items": [{"Name": "House", "Type": "Asset", "Currency": "USD", "Value": 500,
+		"History": [{"Value": -1, "Recorded": "2020-01-01T00:00:00Z"}]}]}`
+	var result ImportResult
+	decodeTestBody(t, alice.expect(http.MethodPost, "/api/itemimport", document, http.StatusOK, "Content-Type", "application/json"), &result)
+	if result.Imported != 0 || len(result.Errors) != 1 || !strings.Contains(result.Errors[0].Error, "must not be negative") {
+		t.Errorf("import gave %+v, want the history reported as negative", result)
+	}
+}
@@ -3,66 +3,395 @@ package main
 import (
 	"context"
 	"database/sql"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
 	ItemTypeAsset     = "Asset"
 	ItemTypeLiability = "Liability"
 	insertItemCommand = `
-INSERT INTO items (uid, name, type, value) VALUES ($1, $2, $3, $4)
+INSERT INTO items (uid, name, type, category, currency, value, version, updated_at) VALUES ($1, $2, $3, $4, $5, $6, 1, $7)
 `
 	updateItemCommand = `
-REPLACE INTO items VALUES ($1, $2, $3, $4, $5)
+UPDATE items SET uid = $1, name = $2, type = $3, category = $4, currency = $5, value = $6, version = version + 1, updated_at = $7
+WHERE id = $8 AND version = $9
 `
 	deleteItemCommand = `
-DELETE FROM items WHERE id = $1
+DELETE FROM items WHERE id = $1 AND version = $2
 `
-	getItemsCommand = `
-SELECT * FROM items WHERE uid = $1
+	findItemValueCommand = `
+SELECT value FROM items WHERE id = $1
+`
+	insertItemValueCommand = `
+INSERT INTO item_values (item_id, value, recorded) VALUES ($1, $2, $3)
+`
+	deleteItemValuesCommand = `
+DELETE FROM item_values WHERE item_id = $1
+`
+	getItemHistoryCommand = `
+SELECT item_id, value, recorded FROM item_values WHERE item_id = $1 ORDER BY recorded, id
+`
+	insertItemTagCommand = `
+INSERT INTO item_tags (item_id, tag) VALUES ($1, $2)
+`
+	deleteItemTagsCommand = `
+DELETE FROM item_tags WHERE item_id = $1
 `
+	getItemTagsCommand = `
+SELECT item_id, tag FROM item_tags WHERE item_id = $1 ORDER BY tag
+`
+	getUserItemTagsCommand = `
+SELECT t.item_id, t.tag FROM item_tags t JOIN items i ON i.id = t.item_id WHERE i.uid = $1 ORDER BY t.tag
+`
+	// filters, ordering and paging are added on by buildItemQuery
+	getItemsCommand = `
+SELECT id, uid, name, type, category, currency, value, version, updated_at FROM items WHERE uid = $1`
 	findItemByIdCommand = `
-SELECT * FROM items WHERE id = $1
+SELECT id, uid, name, type, category, currency, value, version, updated_at FROM items WHERE id = $1
 `
+
+	// escapes LIKE wildcards the same way in every engine
+	likeEscape = "!"
+)
+
+// The built-in category taxonomy, every item belongs to exactly one
+const (
+	ItemCategoryCash        = "cash"
+	ItemCategoryInvestments = "investments"
+	ItemCategoryRetirement  = "retirement"
+	ItemCategoryRealEstate  = "real estate"
+	ItemCategoryVehicles    = "vehicles"
+	ItemCategoryMortgage    = "mortgage"
+	ItemCategoryStudentLoan = "student loan"
+	ItemCategoryAutoLoan    = "auto loan"
+	ItemCategoryCreditCard  = "credit card"
+	ItemCategoryOther       = "other"
 )
 
+var ItemCategories = []string{
+	ItemCategoryCash,
+	ItemCategoryInvestments,
+	ItemCategoryRetirement,
+	ItemCategoryRealEstate,
+	ItemCategoryVehicles,
+	ItemCategoryMortgage,
+	ItemCategoryStudentLoan,
+	ItemCategoryAutoLoan,
+	ItemCategoryCreditCard,
+	ItemCategoryOther,
+}
+
 type ItemEntry struct {
-	Id    int
-	Uid   int
-	Name  string
-	Type  string
-	Value int64
+	Id       int
+	Uid      int
+	Name     string
+	Type     string
+	Category string
+	// ISO 4217 code of the currency Value is counted in
+	Currency string
+	Value    int64
+	Tags     []string
+	// counts the changes made to the item, an update or delete must name
+	// the version it was based on so it cannot overwrite someone else's change
+	Version int
+	Updated time.Time
+	// only read when adding items: their valuation history, oldest first
+	// without it the current value is recorded as of now
+	History []ItemValueEntry `json:",omitempty"`
+}
+
+// The orders items can be listed in, every order falls back on id for ties
+const (
+	ItemSortId      = "id"
+	ItemSortName    = "name"
+	ItemSortValue   = "value"
+	ItemSortUpdated = "updated"
+)
+
+var itemSortColumns = map[string]string{
+	ItemSortId:      "id",
+	ItemSortName:    "name",
+	ItemSortValue:   "value",
+	ItemSortUpdated: "updated_at",
+}
+
+// Narrows down a user's items, fields left at their zero value do not filter
+type ItemFilter struct {
+	Type     string
+	Category string
+	// matched anywhere in the name, ignoring case
+	NameContains string
+	// inclusive bounds on Value, which is in the item's own currency
+	MinValue *int64
+	MaxValue *int64
+}
+
+// Which of a user's items to get and in what order
+type ItemQuery struct {
+	Filter ItemFilter
+	// one of the ItemSort constants, id when empty
+	Sort       string
+	Descending bool
+	// only items which come after this one in the order, for paging
+	// just its Id and the field being sorted on are used
+	After *ItemEntry
+	// the most items to get, 0 for all of them
+	Limit int
+}
+
+// Helper method to build the command for an item query and its arguments
+func buildItemQuery(userid int, query *ItemQuery) (string, []interface{}, error) {
+	var command strings.Builder
+	command.WriteString(getItemsCommand)
+	args := []interface{}{userid}
+	// adds a condition, each ? becomes the next numbered placeholder
+	where := func(condition string, values ...interface{}) {
+		for _, value := range values {
+			args = append(args, value)
+			condition = strings.Replace(condition, "?", "$"+strconv.Itoa(len(args)), 1)
+		}
+		command.WriteString(" AND " + condition)
+	}
+
+	filter := &query.Filter
+	if filter.Type != "" {
+		where("type = ?", filter.Type)
+	}
+	if filter.Category != "" {
+		where("category = ?", filter.Category)
+	}
+	if filter.NameContains != "" {
+		escaped := strings.NewReplacer(likeEscape, likeEscape+likeEscape, "%", likeEscape+"%", "_", likeEscape+"_").
+			Replace(strings.ToLower(filter.NameContains))
+		where("LOWER(name) LIKE ? ESCAPE '"+likeEscape+"'", "%"+escaped+"%")
+	}
+	if filter.MinValue != nil {
+		where("value >= ?", *filter.MinValue)
+	}
+	if filter.MaxValue != nil {
+		where("value <= ?", *filter.MaxValue)
+	}
+
+	sort := query.Sort
+	if sort == "" {
+		sort = ItemSortId
+	}
+	column, ok := itemSortColumns[sort]
+	if !ok {
+		return "", nil, &InvalidItemQueryError{Reason: "Cannot sort by '" + sort + "'."}
+	}
+	direction, after := "ASC", ">"
+	if query.Descending {
+		direction, after = "DESC", "<"
+	}
+
+	// keyset paging: carry on from the last item of the previous page
+	if query.After != nil {
+		if column == "id" {
+			where("id "+after+" ?", query.After.Id)
+		} else {
+			var key interface{}
+			switch sort {
+			case ItemSortName:
+				key = query.After.Name
+			case ItemSortValue:
+				key = query.After.Value
+			case ItemSortUpdated:
+				key = query.After.Updated.Unix()
+			}
+			where("("+column+" "+after+" ? OR ("+column+" = ? AND id "+after+" ?))", key, key, query.After.Id)
+		}
+	}
+
+	command.WriteString(" ORDER BY " + column + " " + direction)
+	if column != "id" {
+		command.WriteString(", id " + direction)
+	}
+	if query.Limit > 0 {
+		command.WriteString(" LIMIT " + strconv.Itoa(query.Limit))
+	}
+	return command.String(), args, nil
 }
 
-func (da DataAccessSQL) AddItem(context context.Context, userid int, name string, itemType string, value int64) error {
-	_, err := da.database.ExecContext(context, insertItemCommand, userid, name, itemType, value)
-	return err
+// A recorded valuation of an item
+type ItemValueEntry struct {
+	ItemId   int
+	Value    int64
+	Recorded time.Time
+}
+
+func (da DataAccessSQL) AddItem(context context.Context, item *ItemEntry) (*ItemEntry, error) {
+	// the item, its tags and its first valuation are written together
+	tx, err := da.begin(context)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// insertItem fills in the id from LastInsertId
+	if err := da.insertItem(context, tx, item); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return da.FindItemById(context, item.Id)
+}
+
+func (da DataAccessSQL) AddItems(context context.Context, items *[]ItemEntry) error {
+	// either every item is added or none are
+	tx, err := da.begin(context)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i := range *items {
+		if err := da.insertItem(context, tx, &(*items)[i]); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Helper method to write an item, its tags and its first valuation as part of a larger transaction
+func (da DataAccessSQL) insertItem(context context.Context, tx sqlRunner, item *ItemEntry) error {
+	result, err := tx.ExecContext(context, da.bind(insertItemCommand), item.Uid, item.Name, item.Type, item.Category, item.Currency, item.Value,
+		time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	item.Id = int(id)
+
+	history := item.History
+	if len(history) == 0 {
+		history = []ItemValueEntry{{Value: item.Value, Recorded: time.Now()}}
+	}
+	for _, value := range history {
+		_, err = tx.ExecContext(context, da.bind(insertItemValueCommand), id, value.Value, value.Recorded.Unix())
+		if err != nil {
+			return err
+		}
+	}
+
+	return da.insertItemTags(context, tx, item.Id, item.Tags)
+}
+
+func (da DataAccessSQL) UpdateItem(context context.Context, item *ItemEntry) (*ItemEntry, error) {
+	// the item, its tags and its valuation history must stay in step
+	tx, err := da.begin(context)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var previous int64
+	err = tx.QueryRowContext(context, da.bind(findItemValueCommand), item.Id).Scan(&previous)
+	if err != nil {
+		return nil, err
+	}
+
+	// the version only matches if nobody else has changed the item since it was read
+	result, err := tx.ExecContext(context, da.bind(updateItemCommand), item.Uid, item.Name, item.Type, item.Category, item.Currency,
+		item.Value, time.Now().Unix(), item.Id, item.Version)
+	if err != nil {
+		return nil, err
+	}
+	if changed, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if changed == 0 {
+		return nil, &ItemVersionConflictError{Id: item.Id, Version: item.Version}
+	}
+
+	// only record the value when it actually changed
+	if item.Value != previous {
+		_, err = tx.ExecContext(context, da.bind(insertItemValueCommand), item.Id, item.Value, time.Now().Unix())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// replace the tags wholesale
+	_, err = tx.ExecContext(context, da.bind(deleteItemTagsCommand), item.Id)
+	if err != nil {
+		return nil, err
+	}
+	if err := da.insertItemTags(context, tx, item.Id, item.Tags); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return da.FindItemById(context, item.Id)
 }
 
-func (da DataAccessSQL) UpdateItem(context context.Context, id int, userid int, name string, itemType string, value int64) error {
-	_, err := da.database.ExecContext(context, updateItemCommand, id, userid, name, itemType, value)
-	return err
+// Helper method to write an item's tags as part of a larger transaction
+func (da DataAccessSQL) insertItemTags(context context.Context, tx sqlRunner, id int, tags []string) error {
+	for _, tag := range tags {
+		if _, err := tx.ExecContext(context, da.bind(insertItemTagCommand), id, tag); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (da DataAccessSQL) DeleteItem(context context.Context, id int) error {
-	_, err := da.database.ExecContext(context, deleteItemCommand, id)
-	return err
+func (da DataAccessSQL) DeleteItem(context context.Context, id int, version int) error {
+	tx, err := da.begin(context)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// clear out the history and tags first so nothing is left pointing at the item
+	_, err = tx.ExecContext(context, da.bind(deleteItemValuesCommand), id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(context, da.bind(deleteItemTagsCommand), id)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(context, da.bind(deleteItemCommand), id, version)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if deleted == 0 {
+		return &ItemVersionConflictError{Id: id, Version: version}
+	}
+
+	return tx.Commit()
 }
 
-func (da DataAccessSQL) GetItemsByUser(context context.Context, userid int) (*[]ItemEntry, error) {
-	rows, err := da.database.QueryContext(context, getItemsCommand, userid)
+func (da DataAccessSQL) GetItemHistory(context context.Context, id int) (*[]ItemValueEntry, error) {
+	rows, err := da.runner().QueryContext(context, da.bind(getItemHistoryCommand), id)
 	// make sure to clean up rows when we're finished
 	defer func() {
-		rows.Close()
+		if rows != nil {
+			rows.Close()
+		}
 	}()
 
-	items := make([]ItemEntry, 0)
+	values := make([]ItemValueEntry, 0)
 	if err == sql.ErrNoRows {
-		return &items, nil
+		return &values, nil
 	} else if err != nil {
 		return nil, err
 	}
 
-	// process the rows into UserEntries
+	// process the rows into ItemValueEntries
 	for rows.Next() {
 		// check for errors
 		err = rows.Err()
@@ -71,25 +400,70 @@ func (da DataAccessSQL) GetItemsByUser(context context.Context, userid int) (*[]
 		}
 
 		// scan the next row
-		var id, uid int
-		var name, itemType string
-		var value int64
-		err = rows.Scan(&id, &uid, &name, &itemType, &value)
+		var itemId int
+		var value, recorded int64
+		err = rows.Scan(&itemId, &value, &recorded)
 		if err != nil {
-			return &items, err
+			return nil, err
+		}
+
+		values = append(values, ItemValueEntry{ItemId: itemId, Value: value, Recorded: time.Unix(recorded, 0)})
+	}
+
+	return &values, nil
+}
+
+func (da DataAccessSQL) GetItemsByUser(context context.Context, userid int, query *ItemQuery) (*[]ItemEntry, error) {
+	if query == nil {
+		query = &ItemQuery{}
+	}
+	command, args, err := buildItemQuery(userid, query)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := da.runner().QueryContext(context, da.bind(command), args...)
+	// make sure to clean up rows when we're finished
+	defer func() {
+		if rows != nil {
+			rows.Close()
 		}
+	}()
+
+	items := make([]ItemEntry, 0)
+	if err == sql.ErrNoRows {
+		return &items, nil
+	} else if err != nil {
+		return nil, err
+	}
 
-		items = append(items, ItemEntry{Id: id, Uid: uid, Name: name, Type: itemType, Value: value})
+	items, err = scanItems(rows)
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// attach the tags to their items
+	tags, err := da.getItemTags(context, getUserItemTagsCommand, userid)
+	if err != nil {
+		return nil, err
+	}
+	for i := range items {
+		if itemTags, ok := tags[items[i].Id]; ok {
+			items[i].Tags = itemTags
+		}
 	}
 
 	return &items, nil
 }
 
 func (da DataAccessSQL) FindItemById(context context.Context, id int) (*ItemEntry, error) {
-	rows, err := da.database.QueryContext(context, findItemByIdCommand, id)
+	rows, err := da.runner().QueryContext(context, da.bind(findItemByIdCommand), id)
 	// make sure to clean up rows when we're finished
 	defer func() {
-		rows.Close()
+		if rows != nil {
+			rows.Close()
+		}
 	}()
 
 	if err == sql.ErrNoRows {
@@ -98,25 +472,85 @@ func (da DataAccessSQL) FindItemById(context context.Context, id int) (*ItemEntr
 		return nil, err
 	}
 
-	// process the rows into UserEntries
+	items, err := scanItems(rows)
+	if err != nil {
+		return nil, err
+	} else if len(items) == 0 {
+		return nil, nil
+	}
+	rows.Close()
+
+	tags, err := da.getItemTags(context, getItemTagsCommand, id)
+	if err != nil {
+		return nil, err
+	}
+	if itemTags, ok := tags[id]; ok {
+		items[0].Tags = itemTags
+	}
+
+	return &items[0], nil
+}
+
+// Helper method to process rows of items into ItemEntries, without their tags
+func scanItems(rows *sql.Rows) ([]ItemEntry, error) {
+	items := make([]ItemEntry, 0)
 	for rows.Next() {
 		// check for errors
-		err = rows.Err()
+		err := rows.Err()
 		if err != nil {
 			return nil, err
 		}
 
 		// scan the next row
 		var id, uid int
-		var name, itemType string
-		var value int64
-		err = rows.Scan(&id, &uid, &name, &itemType, &value)
+		var name, itemType, category, currency string
+		var value, updated int64
+		var version int
+		err = rows.Scan(&id, &uid, &name, &itemType, &category, &currency, &value, &version, &updated)
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, ItemEntry{Id: id, Uid: uid, Name: name, Type: itemType, Category: category, Currency: currency,
+			Value: value, Tags: make([]string, 0), Version: version, Updated: time.Unix(updated, 0)})
+	}
+	return items, nil
+}
+
+// Helper method to load tags, keyed by the id of the item they belong to
+func (da DataAccessSQL) getItemTags(context context.Context, command string, arg interface{}) (map[int][]string, error) {
+	rows, err := da.runner().QueryContext(context, da.bind(command), arg)
+	// make sure to clean up rows when we're finished
+	defer func() {
+		if rows != nil {
+			rows.Close()
+		}
+	}()
+
+	tags := make(map[int][]string)
+	if err == sql.ErrNoRows {
+		return tags, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		// check for errors
+		err = rows.Err()
+		if err != nil {
+			return nil, err
+		}
+
+		// scan the next row
+		var id int
+		var tag string
+		err = rows.Scan(&id, &tag)
 		if err != nil {
 			return nil, err
 		}
 
-		return &ItemEntry{Id: id, Uid: uid, Name: name, Type: itemType, Value: value}, nil
+		tags[id] = append(tags[id], tag)
 	}
 
-	return nil, nil
+	return tags, nil
 }
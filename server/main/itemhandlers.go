@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 	"unicode/utf8"
 )
 
@@ -39,6 +46,61 @@ func (err *ItemDoesNotExistError) Error() string {
 	return "The item with id '" + strconv.Itoa(err.Id) + "' does not exist."
 }
 
+type ItemForbiddenError struct {
+	Id int
+}
+
+func (err *ItemForbiddenError) Error() string {
+	return "You do not have permission to access the item with id '" + strconv.Itoa(err.Id) + "'."
+}
+
+// The item was changed by someone else after the version a change was based on
+type ItemVersionConflictError struct {
+	Id      int
+	Version int
+	// the item as it stands now, when known
+	Current *ItemEntry
+	// set when the version came from an If-Match header, which makes it a failed precondition
+	Precondition bool
+}
+
+func (err *ItemVersionConflictError) Error() string {
+	return "The item with id '" + strconv.Itoa(err.Id) + "' has changed since version " + strconv.Itoa(err.Version) + "."
+}
+
+type ItemVersionRequiredError struct {
+	Id int
+}
+
+func (err *ItemVersionRequiredError) Error() string {
+	return "Changing the item with id '" + strconv.Itoa(err.Id) + "' requires the version it was based on, as an If-Match header or a Version field."
+}
+
+type InvalidItemQueryError struct {
+	Reason string
+}
+
+func (err *InvalidItemQueryError) Error() string {
+	return "Invalid item query: " + err.Reason
+}
+
+type InvalidItemCategoryError struct {
+	Category string
+}
+
+func (err *InvalidItemCategoryError) Error() string {
+	return err.Category + " is an invalid category: Must be one of " + strings.Join(ItemCategories, ", ") + "."
+}
+
+type InvalidItemTagError struct {
+	Tag    string
+	Reason string
+}
+
+func (err *InvalidItemTagError) Error() string {
+	return err.Tag + " is an invalid tag: " + err.Reason
+}
+
 type InvalidItemValueError struct {
 	Reason string
 }
@@ -47,141 +109,646 @@ func (err *InvalidItemValueError) Error() string {
 	return "Invalid item value: " + err.Reason
 }
 
+// Passed as the version of a change to apply it to whichever version is current (If-Match: *)
+const anyItemVersion = -1
+
+const (
+	maxItemTags   = 20
+	maxItemTagLen = 32
+	// the most items a single page of a list may hold
+	maxItemPageSize = 500
+)
+
+// Helper method to fill in defaults and tidy up item inputs before validation
+func normalizeItem(item *ItemEntry) {
+	// items without a category are filed under other
+	if item.Category == "" {
+		item.Category = ItemCategoryOther
+	}
+	item.Currency = strings.ToUpper(strings.TrimSpace(item.Currency))
+
+	// trim tags, and drop blanks and duplicates
+	tags := make([]string, 0, len(item.Tags))
+	seen := make(map[string]bool)
+	for _, tag := range item.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	item.Tags = tags
+}
+
+// Helper method to check a category is part of the taxonomy
+func validateItemCategory(category string) error {
+	for _, valid := range ItemCategories {
+		if category == valid {
+			return nil
+		}
+	}
+	return &InvalidItemCategoryError{Category: category}
+}
+
 // Helper method to validate item inputs (e.g. name length, item type is asset or liability, etc)
-func validateItem(name string, itemType string, value int64) error {
+func validateItem(item *ItemEntry) error {
 	// ensure the name is properly sized
-	namelen := utf8.RuneCountInString(name)
+	namelen := utf8.RuneCountInString(item.Name)
 	if namelen <= 1 {
-		return &InvalidItemNameError{Name: name, Reason: "Must be longer than 1 character."}
+		return &InvalidItemNameError{Name: item.Name, Reason: "Must be longer than 1 character."}
 	} else if namelen >= 200 {
-		return &InvalidItemNameError{Name: name, Reason: "Must be shorter than 200 characters."}
+		return &InvalidItemNameError{Name: item.Name, Reason: "Must be shorter than 200 characters."}
 	}
 
 	// ensure the itemType is valid
-	if itemType != ItemTypeAsset && itemType != ItemTypeLiability {
-		return &InvalidItemTypeError{Type: itemType, Reason: "Must be " + ItemTypeAsset + " or " + ItemTypeLiability}
+	if item.Type != ItemTypeAsset && item.Type != ItemTypeLiability {
+		return &InvalidItemTypeError{Type: item.Type, Reason: "Must be " + ItemTypeAsset + " or " + ItemTypeLiability}
+	}
+
+	// ensure the category is part of the taxonomy
+	if err := validateItemCategory(item.Category); err != nil {
+		return err
+	}
+
+	// ensure the tags are reasonably sized
+	if len(item.Tags) > maxItemTags {
+		return &InvalidItemTagError{Tag: item.Tags[maxItemTags], Reason: fmt.Sprintf("Items may have at most %d tags.", maxItemTags)}
+	}
+	for _, tag := range item.Tags {
+		if utf8.RuneCountInString(tag) > maxItemTagLen {
+			return &InvalidItemTagError{Tag: tag, Reason: fmt.Sprintf("Must be at most %d characters.", maxItemTagLen)}
+		} else if strings.Contains(tag, importTagSeparator) {
+			// tags share a single column in CSV files
+			return &InvalidItemTagError{Tag: tag, Reason: "Must not contain '" + importTagSeparator + "'."}
+		}
+	}
+
+	// ensure the currency looks like ISO 4217
+	if _, err := normalizeCurrency(item.Currency); err != nil {
+		return err
 	}
 
 	// ensure the value is not negative
-	if value < 0 {
-		return &InvalidItemValueError{Reason: "Must be greater than zero."}
+	if item.Value < 0 {
+		return &InvalidItemValueError{Reason: "Must not be negative."}
 	}
 
 	return nil
 }
 
+// Helper method to find an item and verify that it belongs to the acting user
+func findOwnedItem(context context.Context, da DataAccess, user *UserEntry, id int) (*ItemEntry, error) {
+	// verify the item id already exists
+	item, err := da.FindItemById(context, id)
+	if err != nil {
+		return nil, err
+	} else if item == nil {
+		return nil, &ItemDoesNotExistError{Id: id}
+	}
+
+	// verify the item is the user's to change
+	if item.Uid != user.Id {
+		return nil, &ItemForbiddenError{Id: id}
+	}
+
+	return item, nil
+}
+
+// Helper method to verify a change is based on the current version of an item
+// anyItemVersion stands for whichever version is current
+func checkItemVersion(existing *ItemEntry, version int) (int, error) {
+	if version == anyItemVersion {
+		return existing.Version, nil
+	} else if version <= 0 {
+		return 0, &ItemVersionRequiredError{Id: existing.Id}
+	} else if version != existing.Version {
+		return 0, &ItemVersionConflictError{Id: existing.Id, Version: version, Current: existing}
+	}
+	return version, nil
+}
+
+// Helper method to attach the current state of an item to a version conflict
+// which the database found, i.e. a change made between our read and our write
+func currentItemConflict(context context.Context, da DataAccess, err error) error {
+	var conflict *ItemVersionConflictError
+	if errors.As(err, &conflict) && conflict.Current == nil {
+		conflict.Current, _ = da.FindItemById(context, conflict.Id)
+	}
+	return err
+}
+
+// Gets the ETag of an item, which is its version
+func itemETag(item *ItemEntry) string {
+	return "\"" + strconv.Itoa(item.Version) + "\""
+}
+
+// Helper method to find the version a change is based on, from an If-Match
+// header when there is one and otherwise from the request body
+// The bool reports whether If-Match was used, in which case a stale
+// version is a failed precondition rather than a conflict
+func requestItemVersion(request *http.Request, bodyVersion int) (int, bool, error) {
+	match := strings.TrimSpace(request.Header.Get("If-Match"))
+	if match == "" {
+		return bodyVersion, false, nil
+	} else if match == "*" {
+		return anyItemVersion, true, nil
+	}
+
+	version, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(match, "W/"), "\""))
+	if err != nil || version <= 0 {
+		return 0, true, &InvalidRequestError{Field: "If-Match", Reason: "Must be the ETag of an item."}
+	}
+	return version, true, nil
+}
+
+// Helper method to report a stale version from If-Match as a failed precondition
+func versionError(err error, fromHeader bool) error {
+	var conflict *ItemVersionConflictError
+	if fromHeader && errors.As(err, &conflict) {
+		conflict.Precondition = true
+	}
+	return err
+}
+
 // Performs validation on item inputs and then tries to add the new item to the database
-func AddItem(da DataAccess, name string, itemType string, username string, value int64) error {
-	// run standard validation
-	if err := validateItem(name, itemType, value); err != nil {
-		return err
+func AddItem(context context.Context, da DataAccess, user *UserEntry, item *ItemEntry) (*ItemEntry, error) {
+	// items are counted in the user's own currency unless told otherwise
+	if item.Currency == "" {
+		item.Currency = user.BaseCurrency
 	}
 
-	// find the user and verify they exist
-	user, err := FindUserByName(da, username)
-	if err != nil {
-		return err
+	// run standard validation
+	normalizeItem(item)
+	if err := validateItem(item); err != nil {
+		return nil, err
 	}
 
 	// try to add the new item
-	return da.AddItem(context.Background(), user.Id, name, itemType, value)
+	item.Uid = user.Id
+	return da.AddItem(context, item)
 }
 
 // Performs validation on item inputs and then tries to update the existing item
-func UpdateItem(da DataAccess, id int, name string, itemType string, username string, value int64) error {
-	// verify the item id already exists
-	item, err := da.FindItemById(context.Background(), id)
-	if err != nil || item == nil {
-		return &ItemDoesNotExistError{Id: id}
+func UpdateItem(context context.Context, da DataAccess, user *UserEntry, item *ItemEntry) (*ItemEntry, error) {
+	// verify the item exists and belongs to the user
+	existing, err := findOwnedItem(context, da, user, item.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	// items are counted in the user's own currency unless told otherwise
+	if item.Currency == "" {
+		item.Currency = user.BaseCurrency
 	}
 
 	// run standard validation
-	if err := validateItem(name, itemType, value); err != nil {
-		return err
+	normalizeItem(item)
+	if err := validateItem(item); err != nil {
+		return nil, err
+	}
+
+	// and that nobody has changed it in the meantime
+	if item.Version, err = checkItemVersion(existing, item.Version); err != nil {
+		return nil, err
 	}
 
-	// find the user and verify they exist
-	user, err := FindUserByName(da, username)
+	// try to update the item, it always stays with its owner
+	item.Uid = existing.Uid
+	stored, err := da.UpdateItem(context, item)
+	return stored, currentItemConflict(context, da, err)
+}
+
+// Tries to delete an item belonging to the user
+func DeleteItem(context context.Context, da DataAccess, user *UserEntry, id int, version int) error {
+	// verify the item exists and belongs to the user
+	existing, err := findOwnedItem(context, da, user, id)
 	if err != nil {
 		return err
 	}
 
-	// try to update the item
-	return da.UpdateItem(context.Background(), id, user.Id, name, itemType, value)
-}
+	// and that nobody has changed it in the meantime
+	if version, err = checkItemVersion(existing, version); err != nil {
+		return err
+	}
 
-// Tries to delete an item
-func DeleteItem(da DataAccess, id int) error {
 	// try to delete the item
-	return da.DeleteItem(context.Background(), id)
+	return currentItemConflict(context, da, da.DeleteItem(context, id, version))
+}
+
+// The fields of an item a client may set, named as they are in ItemEntry
+type itemDocument struct {
+	Name     string
+	Type     string
+	Category string
+	Currency string
+	Value    int64
+	Tags     []string
+}
+
+// Applies a JSON Merge Patch (RFC 7386) to a decoded JSON document
+// Objects are merged key by key, a null removes a key and anything else replaces the target
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+	return targetObject
 }
 
+// Fields every item must have, so a merge patch can change them but not remove them
+var requiredItemFields = []string{"Name", "Type", "Value"}
+
+// Helper method to read a merge patch for an item from a request body
+// A Version in the patch is not a change, it is the version the patch is
+// based on, and is returned separately
+func readItemPatch(reader io.Reader) (map[string]interface{}, int, error) {
+	var patch interface{}
+	decoder := json.NewDecoder(reader)
+	// keep large values exact rather than passing them through a float
+	decoder.UseNumber()
+	if err := decoder.Decode(&patch); err != nil {
+		return nil, 0, &InvalidRequestError{Reason: err.Error()}
+	}
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return nil, 0, &InvalidRequestError{Reason: "A merge patch of an item must be a JSON object."}
+	}
+	// a null would remove the field, leaving e.g. a Value of 0 the client never sent
+	for _, field := range requiredItemFields {
+		if value, ok := patchObject[field]; ok && value == nil {
+			return nil, 0, &InvalidRequestError{Field: field, Reason: "Cannot be removed, every item has one."}
+		}
+	}
+
+	version := 0
+	if value, ok := patchObject["Version"]; ok {
+		number, ok := value.(json.Number)
+		parsed, err := number.Int64()
+		if !ok || err != nil {
+			return nil, 0, &InvalidRequestError{Field: "Version", Reason: "Must be a whole number."}
+		}
+		version = int(parsed)
+		delete(patchObject, "Version")
+	}
+	return patchObject, version, nil
+}
+
+// Applies a merge patch to an item belonging to the user
+// Only the merged result is validated, so a patch can name just the fields it changes;
+// removing a field with null resets it (e.g. Category to other, Currency to the user's own)
+func PatchItem(context context.Context, da DataAccess, user *UserEntry, id int, patch map[string]interface{}, version int) (*ItemEntry, error) {
+	// verify the item exists and belongs to the user
+	existing, err := findOwnedItem(context, da, user, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// bring the item into the same decoded form as the patch
+	encoded, err := json.Marshal(itemDocument{Name: existing.Name, Type: existing.Type, Category: existing.Category,
+		Currency: existing.Currency, Value: existing.Value, Tags: existing.Tags})
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+
+	// merge, then read the result back, anything which is not an item field is refused
+	merged, err := json.Marshal(mergePatch(document, patch))
+	if err != nil {
+		return nil, err
+	}
+	decoder = json.NewDecoder(bytes.NewReader(merged))
+	decoder.DisallowUnknownFields()
+	var result itemDocument
+	if err := decoder.Decode(&result); err != nil {
+		return nil, &InvalidRequestError{Reason: err.Error()}
+	}
+
+	// the update validates the merged item and checks the version
+	item := ItemEntry{Id: id, Name: result.Name, Type: result.Type, Category: result.Category, Currency: result.Currency,
+		Value: result.Value, Tags: result.Tags, Version: version}
+	return UpdateItem(context, da, user, &item)
+}
+
+// Gets the valuation timeline of an item belonging to the user, oldest first
+func GetItemHistory(context context.Context, da DataAccess, user *UserEntry, id int) (*[]ItemValueEntry, error) {
+	// verify the item exists and belongs to the user
+	if _, err := findOwnedItem(context, da, user, id); err != nil {
+		return nil, err
+	}
+
+	return da.GetItemHistory(context, id)
+}
+
+// Net worth and its parts for some group of items
+type ItemTotals struct {
+	NetWorth       int64
+	AssetTotal     int64
+	LiabilityTotal int64
+}
+
+// Helper method to count an item's value towards a set of totals
+func (totals *ItemTotals) add(itemType string, value int64) {
+	if itemType == ItemTypeAsset {
+		totals.NetWorth += value
+		totals.AssetTotal += value
+	} else if itemType == ItemTypeLiability {
+		totals.NetWorth -= value
+		totals.LiabilityTotal += value
+	}
+}
+
+// The response to adding or updating an item: the item as stored and the user's totals afterwards
+type ItemChange struct {
+	Item         *ItemEntry
+	BaseCurrency string
+	// left out when the totals could not be worked out, e.g. for want of an exchange rate
+	Totals *ItemTotals `json:",omitempty"`
+}
+
+// Helper method to pair a changed item with the user's recomputed totals
+// The change has already been made, so failing to total is not treated as an error
+func itemChange(context context.Context, da DataAccess, user *UserEntry, item *ItemEntry) *ItemChange {
+	change := ItemChange{Item: item, BaseCurrency: user.BaseCurrency}
+	itemList, err := GetItems(context, da, user, nil)
+	if err != nil {
+		logError(context, "Failed to total items", errorField(err))
+		return &change
+	}
+
+	change.Totals = &ItemTotals{NetWorth: itemList.NetWorth, AssetTotal: itemList.AssetTotal, LiabilityTotal: itemList.LiabilityTotal}
+	return &change
+}
+
+// How an item's value was converted into the user's base currency
+type ItemConversion struct {
+	ItemId   int
+	Currency string
+	Rate     float64
+	// the day the rate took effect, zero when no conversion was needed
+	RateDate time.Time
+	Value    int64
+	// set when there is no rate for the item's currency, Value is then left in
+	// that currency and the item is not counted in any of the totals
+	Unconverted bool `json:",omitempty"`
+}
+
+// The items asked for, and totals over every item which matched the filter
 type ItemList struct {
-	Username       string
-	Items          *[]ItemEntry
+	Username string
+	Items    *[]ItemEntry
+	// how many items matched the filter, across all pages
+	Count int
+	// pass this back as the cursor to get the next page, empty on the last page
+	NextCursor string `json:",omitempty"`
+	// every total is counted in this currency
+	BaseCurrency string
+	// one per item, in the same order as Items
+	Conversions    []ItemConversion
 	NetWorth       int64
 	AssetTotal     int64
 	LiabilityTotal int64
+	CategoryTotals map[string]*ItemTotals
+	// an item counts towards each of its tags, so these may overlap
+	TagTotals map[string]*ItemTotals
+	// set when some items matched but could not be converted, the totals leave them out
+	Incomplete bool `json:",omitempty"`
 }
 
 // Gets all of the items for a given user, and calculates certain analytics
-func GetItems(da DataAccess, username string) (*ItemList, error) {
-	// find the user and verify they exist
-	user, err := FindUserByName(da, username)
-	if err != nil {
-		return nil, err
+// A nil query gets every item in the order they were added
+func GetItems(context context.Context, da DataAccess, user *UserEntry, query *ItemQuery) (*ItemList, error) {
+	if query == nil {
+		query = &ItemQuery{}
 	}
 
-	// try to get their items
-	items, err := da.GetItemsByUser(context.Background(), user.Id)
+	// everything is read in one transaction, so a write in between can't leave the totals at odds with the page
+	paged := query.Sort != "" || query.Descending || query.After != nil || query.Limit > 0
+	var items, page *[]ItemEntry
+	var rates *[]ExchangeRateEntry
+	err := da.WithTransaction(context, func(tx DataAccess) error {
+		// try to get their items, all those which match so the totals cover more than one page
+		var err error
+		if items, err = tx.GetItemsByUser(context, user.Id, &ItemQuery{Filter: query.Filter}); err != nil {
+			return err
+		}
+
+		// and the rates to bring them all into one currency
+		if rates, err = tx.GetExchangeRates(context); err != nil {
+			return err
+		}
+
+		// then the page which was asked for, when it is not simply all of them
+		page = items
+		if paged {
+			pageQuery := *query
+			if query.Limit > 0 {
+				// one more than needed tells us whether there is another page
+				pageQuery.Limit++
+			}
+			page, err = tx.GetItemsByUser(context, user.Id, &pageQuery)
+		}
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-
-	// calculate net worth, asset total, liability total
-	var net, asset, liability int64
+	table := exchangeRateTable(*rates)
+	now := time.Now()
+
+	// calculate net worth, asset total, liability total, overall and per category and tag
+	// an item without an exchange rate is still listed, so one missing rate doesn't hide the rest
+	var totals ItemTotals
+	incomplete := false
+	conversions := make(map[int]ItemConversion, len(*items))
+	categoryTotals := make(map[string]*ItemTotals)
+	tagTotals := make(map[string]*ItemTotals)
 	for i := range *items {
-		if (*items)[i].Type == ItemTypeAsset {
-			net += (*items)[i].Value
-			asset += (*items)[i].Value
-		} else if (*items)[i].Type == ItemTypeLiability {
-			net -= (*items)[i].Value
-			liability += (*items)[i].Value
+		item := &(*items)[i]
+
+		rate, err := table.find(item.Currency, user.BaseCurrency, now)
+		if _, missing := err.(*MissingExchangeRateError); missing {
+			conversions[item.Id] = ItemConversion{ItemId: item.Id, Currency: item.Currency, Value: item.Value, Unconverted: true}
+			incomplete = true
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		value := convertValue(item.Value, rate.Rate)
+		conversions[item.Id] = ItemConversion{ItemId: item.Id, Currency: item.Currency, Rate: rate.Rate,
+			RateDate: rate.Date, Value: value}
+
+		totals.add(item.Type, value)
+
+		if categoryTotals[item.Category] == nil {
+			categoryTotals[item.Category] = &ItemTotals{}
+		}
+		categoryTotals[item.Category].add(item.Type, value)
+
+		for _, tag := range item.Tags {
+			if tagTotals[tag] == nil {
+				tagTotals[tag] = &ItemTotals{}
+			}
+			tagTotals[tag].add(item.Type, value)
 		}
 	}
 
-	return &ItemList{Username: username, Items: items, NetWorth: net, AssetTotal: asset, LiabilityTotal: liability}, nil
+	// the extra item fetched for the page only says whether there is another
+	nextCursor := ""
+	if paged && query.Limit > 0 && len(*page) > query.Limit {
+		trimmed := (*page)[:query.Limit]
+		page = &trimmed
+		nextCursor = encodeItemCursor(query, &trimmed[len(trimmed)-1])
+	}
+
+	pageConversions := make([]ItemConversion, 0, len(*page))
+	for _, item := range *page {
+		pageConversions = append(pageConversions, conversions[item.Id])
+	}
+
+	return &ItemList{Username: user.Name, Items: page, Count: len(*items), NextCursor: nextCursor,
+		BaseCurrency: user.BaseCurrency, Conversions: pageConversions, Incomplete: incomplete,
+		NetWorth: totals.NetWorth, AssetTotal: totals.AssetTotal, LiabilityTotal: totals.LiabilityTotal,
+		CategoryTotals: categoryTotals, TagTotals: tagTotals}, nil
 }
 
-type getItemsRequest struct {
-	Username string
+// Where a page of items ended, handed to clients as an opaque string
+// It remembers the order it was made for, since it means nothing in any other
+type itemCursor struct {
+	Sort       string
+	Descending bool
+	Id         int
+	Name       string
+	Value      int64
+	Updated    int64
+}
+
+// Helper method to make the cursor for the page after a given item
+func encodeItemCursor(query *ItemQuery, item *ItemEntry) string {
+	encoded, _ := json.Marshal(itemCursor{Sort: query.Sort, Descending: query.Descending, Id: item.Id, Name: item.Name,
+		Value: item.Value, Updated: item.Updated.Unix()})
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// Helper method to read a cursor back into the query it continues
+func decodeItemCursor(cursor string, query *ItemQuery) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	var parsed itemCursor
+	if err == nil {
+		err = json.Unmarshal(decoded, &parsed)
+	}
+	if err != nil {
+		return &InvalidItemQueryError{Reason: "The cursor is not one we gave out."}
+	}
+	if parsed.Sort != query.Sort || parsed.Descending != query.Descending {
+		return &InvalidItemQueryError{Reason: "The cursor was made for a different order."}
+	}
+
+	query.After = &ItemEntry{Id: parsed.Id, Name: parsed.Name, Value: parsed.Value, Updated: time.Unix(parsed.Updated, 0)}
+	return nil
+}
+
+// Reads an item query from url parameters, all of which are optional:
+// type, category, name (a substring), minValue and maxValue (in hundredths),
+// sort (id, name, value or updated), order (asc or desc), limit and cursor
+func parseItemQuery(values url.Values) (*ItemQuery, error) {
+	query := ItemQuery{Filter: ItemFilter{Type: values.Get("type"), Category: values.Get("category"),
+		NameContains: values.Get("name")}, Sort: values.Get("sort")}
+
+	if query.Filter.Type != "" && query.Filter.Type != ItemTypeAsset && query.Filter.Type != ItemTypeLiability {
+		return nil, &InvalidItemTypeError{Type: query.Filter.Type, Reason: "Must be " + ItemTypeAsset + " or " + ItemTypeLiability}
+	}
+	if query.Filter.Category != "" {
+		if err := validateItemCategory(query.Filter.Category); err != nil {
+			return nil, err
+		}
+	}
+	for _, bound := range []struct {
+		name  string
+		value **int64
+	}{{"minValue", &query.Filter.MinValue}, {"maxValue", &query.Filter.MaxValue}} {
+		if value := values.Get(bound.name); value != "" {
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, &InvalidRequestError{Field: bound.name, Reason: "Must be a whole number of hundredths."}
+			}
+			*bound.value = &parsed
+		}
+	}
+
+	if _, ok := itemSortColumns[query.Sort]; query.Sort != "" && !ok {
+		return nil, &InvalidItemQueryError{Reason: "Cannot sort by '" + query.Sort + "', must be id, name, value or updated."}
+	}
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return nil, &InvalidRequestError{Field: "order", Reason: "Must be asc or desc."}
+	}
+
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxItemPageSize {
+			return nil, &InvalidRequestError{Field: "limit", Reason: fmt.Sprintf("Must be between 1 and %d.", maxItemPageSize)}
+		}
+		query.Limit = limit
+	}
+	if cursor := values.Get("cursor"); cursor != "" {
+		if err := decodeItemCursor(cursor, &query); err != nil {
+			return nil, err
+		}
+	}
+	return &query, nil
 }
 
 type addItemRequest struct {
-	Username string
 	Name     string
 	ItemType string
+	Category string
+	Currency string
 	Value    int64
+	Tags     []string
 }
 
 type updateItemRequest struct {
 	Id       int
-	Username string
 	Name     string
 	ItemType string
+	Category string
+	Currency string
 	Value    int64
+	Tags     []string
+	// the version the update is based on, unless an If-Match header is sent
+	Version int
 }
 
 type deleteItemRequest struct {
 	Id int
+	// the version the delete is based on, unless an If-Match header is sent
+	Version int
 }
 
 // Handles the incoming http requests for the item API
 func (ih itemHandlers) ItemRequestHandler(writer http.ResponseWriter, request *http.Request) {
-	writer.Header().Set("Content-Type", "application/json")
-	writer.Header().Set("Access-Control-Allow-Origin", "*")
-	writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-	writer.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	writeAPIHeaders(writer, request)
 
 	switch request.Method {
 	case http.MethodOptions:
@@ -191,97 +758,144 @@ func (ih itemHandlers) ItemRequestHandler(writer http.ResponseWriter, request *h
 		var addRequest addItemRequest
 		err := json.NewDecoder(request.Body).Decode(&addRequest)
 		if err != nil {
-			fmt.Println("Failed to decode add item request: " + err.Error())
-			http.Error(writer, err.Error(), http.StatusBadRequest)
+			logWarn(request.Context(), "Failed to decode add item request", errorField(err))
+			writeError(writer, request, &InvalidRequestError{Reason: err.Error()})
 			return
 		}
 
-		err = AddItem(ih.da, addRequest.Name, addRequest.ItemType, addRequest.Username, addRequest.Value)
+		item := ItemEntry{Name: addRequest.Name, Type: addRequest.ItemType, Category: addRequest.Category,
+			Currency: addRequest.Currency, Value: addRequest.Value, Tags: addRequest.Tags}
+		user := requestUser(request)
+		stored, err := AddItem(request.Context(), ih.da, user, &item)
 		if err != nil {
-			fmt.Println("Failed to add item: " + err.Error())
-			http.Error(writer, err.Error(), http.StatusBadRequest)
+			logWarn(request.Context(), "Failed to add item", errorField(err))
+			writeError(writer, request, err)
 			return
 		}
+		writer.Header().Set("ETag", itemETag(stored))
+
+		// respond with the item as stored and the new totals
+		json.NewEncoder(writer).Encode(itemChange(request.Context(), ih.da, user, stored))
 	case http.MethodPut:
 		// try to update an existing item
 		var updateRequest updateItemRequest
 		err := json.NewDecoder(request.Body).Decode(&updateRequest)
 		if err != nil {
-			fmt.Println("Failed to update item: " + err.Error())
-			http.Error(writer, err.Error(), http.StatusBadRequest)
+			logWarn(request.Context(), "Failed to update item", errorField(err))
+			writeError(writer, request, &InvalidRequestError{Reason: err.Error()})
+			return
+		}
+
+		version, fromHeader, err := requestItemVersion(request, updateRequest.Version)
+		if err != nil {
+			writeError(writer, request, err)
+			return
+		}
+
+		item := ItemEntry{Id: updateRequest.Id, Name: updateRequest.Name, Type: updateRequest.ItemType,
+			Category: updateRequest.Category, Currency: updateRequest.Currency, Value: updateRequest.Value, Tags: updateRequest.Tags,
+			Version: version}
+		user := requestUser(request)
+		stored, err := UpdateItem(request.Context(), ih.da, user, &item)
+		if err != nil {
+			logWarn(request.Context(), "Failed to update item", errorField(err))
+			writeError(writer, request, versionError(err, fromHeader))
+			return
+		}
+		writer.Header().Set("ETag", itemETag(stored))
+
+		// respond with the item as stored and the new totals
+		json.NewEncoder(writer).Encode(itemChange(request.Context(), ih.da, user, stored))
+	case http.MethodPatch:
+		// try to apply a merge patch to the item chosen by the "id" query parameter
+		id, err := strconv.Atoi(request.URL.Query().Get("id"))
+		if err != nil {
+			writeError(writer, request, &InvalidRequestError{Field: "id", Reason: "Must be an item id."})
+			return
+		}
+		patch, bodyVersion, err := readItemPatch(request.Body)
+		if err != nil {
+			writeError(writer, request, err)
+			return
+		}
+		version, fromHeader, err := requestItemVersion(request, bodyVersion)
+		if err != nil {
+			writeError(writer, request, err)
 			return
 		}
 
-		err = UpdateItem(ih.da, updateRequest.Id, updateRequest.Name, updateRequest.ItemType, updateRequest.Username, updateRequest.Value)
+		user := requestUser(request)
+		stored, err := PatchItem(request.Context(), ih.da, user, id, patch, version)
 		if err != nil {
-			fmt.Println("Failed to update item: " + err.Error())
-			http.Error(writer, err.Error(), http.StatusBadRequest)
+			logWarn(request.Context(), "Failed to patch item", errorField(err))
+			writeError(writer, request, versionError(err, fromHeader))
 			return
 		}
+		writer.Header().Set("ETag", itemETag(stored))
+
+		// respond with the item as stored and the new totals
+		json.NewEncoder(writer).Encode(itemChange(request.Context(), ih.da, user, stored))
 	case http.MethodDelete:
 		// try to delete an existing item
 		var deleteRequest deleteItemRequest
 		err := json.NewDecoder(request.Body).Decode(&deleteRequest)
 		if err != nil {
-			fmt.Println("Failed to delete item: " + err.Error())
-			http.Error(writer, err.Error(), http.StatusBadRequest)
+			logWarn(request.Context(), "Failed to delete item", errorField(err))
+			writeError(writer, request, &InvalidRequestError{Reason: err.Error()})
 			return
 		}
 
-		fmt.Println("Received delete request for item " + strconv.Itoa(deleteRequest.Id))
+		logDebug(request.Context(), "Received delete item request", field("item", deleteRequest.Id))
+
+		version, fromHeader, err := requestItemVersion(request, deleteRequest.Version)
+		if err != nil {
+			writeError(writer, request, err)
+			return
+		}
 
-		err = DeleteItem(ih.da, deleteRequest.Id)
+		err = DeleteItem(request.Context(), ih.da, requestUser(request), deleteRequest.Id, version)
 		if err != nil {
-			fmt.Println("Failed to delete item: " + err.Error())
-			http.Error(writer, err.Error(), http.StatusBadRequest)
+			logWarn(request.Context(), "Failed to delete item", errorField(err))
+			writeError(writer, request, versionError(err, fromHeader))
 			return
 		}
 	default:
-		http.Error(writer, "Invalid request method.", 405)
+		writeError(writer, request, &MethodNotAllowedError{Method: request.Method})
 	}
 }
 
 func (ih itemHandlers) ItemListRequestHandler(writer http.ResponseWriter, request *http.Request) {
-	writer.Header().Set("Content-Type", "application/json")
-	writer.Header().Set("Access-Control-Allow-Origin", "*")
-	writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-	writer.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	writeAPIHeaders(writer, request)
 
 	switch request.Method {
 	case http.MethodOptions:
 		return
 	case http.MethodPost:
-		// return a json of this user's items
-		// decode the request
-		var getRequest getItemsRequest
-		err := json.NewDecoder(request.Body).Decode(&getRequest)
+		// return a json of the logged in user's items
+		user := requestUser(request)
+		logDebug(request.Context(), "Received get items request")
+		query, err := parseItemQuery(request.URL.Query())
 		if err != nil {
-			fmt.Println("Failed to decode get items request: " + err.Error())
-			http.Error(writer, err.Error(), http.StatusBadRequest)
+			writeError(writer, request, err)
 			return
 		}
 
-		// look up the items
-		fmt.Println("Received get items request for '" + getRequest.Username + "'")
-		itemList, err := GetItems(ih.da, getRequest.Username)
+		itemList, err := GetItems(request.Context(), ih.da, user, query)
 		if err != nil {
-			fmt.Println("Failed to get items: " + err.Error())
-			http.Error(writer, err.Error(), http.StatusBadRequest)
+			logWarn(request.Context(), "Failed to get items", errorField(err))
+			writeError(writer, request, err)
 			return
 		}
 
 		// respond with the item list
 		json.NewEncoder(writer).Encode(itemList)
 	default:
-		http.Error(writer, "Invalid request method.", 405)
+		writeError(writer, request, &MethodNotAllowedError{Method: request.Method})
 	}
 }
 
 func (ih itemHandlers) ItemDeleteRequestHandler(writer http.ResponseWriter, request *http.Request) {
-	writer.Header().Set("Content-Type", "application/json")
-	writer.Header().Set("Access-Control-Allow-Origin", "*")
-	writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-	writer.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	writeAPIHeaders(writer, request)
 
 	switch request.Method {
 	case http.MethodOptions:
@@ -291,20 +905,54 @@ func (ih itemHandlers) ItemDeleteRequestHandler(writer http.ResponseWriter, requ
 		var deleteRequest deleteItemRequest
 		err := json.NewDecoder(request.Body).Decode(&deleteRequest)
 		if err != nil {
-			fmt.Println("Failed to delete item: " + err.Error())
-			http.Error(writer, err.Error(), http.StatusBadRequest)
+			logWarn(request.Context(), "Failed to delete item", errorField(err))
+			writeError(writer, request, &InvalidRequestError{Reason: err.Error()})
 			return
 		}
 
-		fmt.Println("Received delete request for item " + strconv.Itoa(deleteRequest.Id))
+		logDebug(request.Context(), "Received delete item request", field("item", deleteRequest.Id))
+
+		version, fromHeader, err := requestItemVersion(request, deleteRequest.Version)
+		if err != nil {
+			writeError(writer, request, err)
+			return
+		}
 
-		err = DeleteItem(ih.da, deleteRequest.Id)
+		err = DeleteItem(request.Context(), ih.da, requestUser(request), deleteRequest.Id, version)
 		if err != nil {
-			fmt.Println("Failed to delete item: " + err.Error())
-			http.Error(writer, err.Error(), http.StatusBadRequest)
+			logWarn(request.Context(), "Failed to delete item", errorField(err))
+			writeError(writer, request, versionError(err, fromHeader))
 			return
 		}
 	default:
-		http.Error(writer, "Invalid request method.", 405)
+		writeError(writer, request, &MethodNotAllowedError{Method: request.Method})
+	}
+}
+
+// Handles the incoming http requests for an item's valuation history
+// The item is chosen by the "id" query parameter
+func (ih itemHandlers) ItemHistoryRequestHandler(writer http.ResponseWriter, request *http.Request) {
+	writeAPIHeaders(writer, request)
+
+	switch request.Method {
+	case http.MethodOptions:
+		return
+	case http.MethodGet:
+		id, err := strconv.Atoi(request.URL.Query().Get("id"))
+		if err != nil {
+			writeError(writer, request, &InvalidRequestError{Field: "id", Reason: "Must be an item id."})
+			return
+		}
+
+		history, err := GetItemHistory(request.Context(), ih.da, requestUser(request), id)
+		if err != nil {
+			logWarn(request.Context(), "Failed to get item history", errorField(err))
+			writeError(writer, request, err)
+			return
+		}
+
+		json.NewEncoder(writer).Encode(history)
+	default:
+		writeError(writer, request, &MethodNotAllowedError{Method: request.Method})
 	}
 }
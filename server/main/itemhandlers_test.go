@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Helper method to add an item through the v1 api, giving it as stored
+func addTestItem(client *testClient, name string, value int64) *ItemEntry {
+	client.t.Helper()
+	content := client.expect(http.MethodPost, "/api/item",
+		map[string]interface{}{"Name": name, "ItemType": ItemTypeAsset, "Value": value}, http.StatusOK)
+	var change ItemChange
+	decodeTestBody(client.t, content, &change)
+	return change.Item
+}
+
+// Helper method to check an item is still as it was added, at version 1
+func expectItemUnchanged(t *testing.T, da DataAccess, item *ItemEntry) {
+	t.Helper()
+	found, err := da.FindItemById(context.Background(), item.Id)
+	if err != nil || found == nil {
+		t.Fatalf("item %d is gone: %v", item.Id, err)
+	}
+	if found.Version != 1 || found.Value != item.Value || found.Name != item.Name {
+		t.Errorf("item changed to %+v", found)
+	}
+}
+
+func TestFindOwnedItemForbidsOtherUsers(t *testing.T) {
+	api := newTestAPI(t)
+	item := addTestItem(api.login(t, "alice"), "House", 500)
+	api.login(t, "bob")
+
+	bob, err := api.da.FindUserByName(context.Background(), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var forbidden *ItemForbiddenError
+	if _, err := findOwnedItem(context.Background(), api.da, bob, item.Id); !errors.As(err, &forbidden) {
+		t.Errorf("bob finding alice's item gave %v, want ItemForbiddenError", err)
+	}
+	var missing *ItemDoesNotExistError
+	if _, err := findOwnedItem(context.Background(), api.da, bob, item.Id+100); !errors.As(err, &missing) {
+		t.Errorf("finding a missing item gave %v, want ItemDoesNotExistError", err)
+	}
+}
+
+func TestItemsCannotBeChangedByOtherUsers(t *testing.T) {
+	api := newTestAPI(t)
+	item := addTestItem(api.login(t, "alice"), "House", 500)
+	bob := api.login(t, "bob")
+	id := strconv.Itoa(item.Id)
+
+	for _, attempt := range []struct {
+		method string
+		path   string
+		body   interface{}
+	}{
+		{http.MethodPut, "/api/item", map[string]interface{}{"Id": item.Id, "Name": "Mine", "ItemType": ItemTypeAsset, "Value": 1, "Version": 1}},
+		{http.MethodPatch, "/api/item?id=" + id, map[string]interface{}{"Value": 1, "Version": 1}},
+		{http.MethodDelete, "/api/item", map[string]interface{}{"Id": item.Id, "Version": 1}},
+		{http.MethodPost, "/api/itemdelete", map[string]interface{}{"Id": item.Id, "Version": 1}},
+		{http.MethodGet, "/api/itemhistory?id=" + id, nil},
+	} {
+		content := bob.expect(attempt.method, attempt.path, attempt.body, http.StatusForbidden)
+		expectErrorCode(t, content, "item_forbidden")
+	}
+
+	// and bob's own list doesn't show it
+	var list ItemList
+	decodeTestBody(t, bob.expect(http.MethodPost, "/api/itemlist", nil, http.StatusOK), &list)
+	if list.Count != 0 {
+		t.Errorf("bob sees %d items", list.Count)
+	}
+	expectItemUnchanged(t, api.da, item)
+}
+
+func TestStaleVersionsAreRejected(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.login(t, "alice")
+	item := addTestItem(alice, "House", 500)
+	update := map[string]interface{}{"Id": item.Id, "Name": "House", "ItemType": ItemTypeAsset, "Value": 600, "Version": 1}
+
+	response, _ := alice.do(http.MethodPut, "/api/item", update)
+	if response.StatusCode != http.StatusOK || response.Header.Get("ETag") != `"2"` {
+		t.Fatalf("update gave %d with ETag %s", response.StatusCode, response.Header.Get("ETag"))
+	}
+
+	// the same change again is now based on an old version, and says what is current
+	content := alice.expect(http.MethodPut, "/api/item", update, http.StatusConflict)
+	var conflict struct {
+		Code    string
+		Current *ItemEntry
+	}
+	decodeTestBody(t, content, &conflict)
+	if conflict.Code != "item_version_conflict" || conflict.Current == nil || conflict.Current.Version != 2 {
+		t.Errorf("conflict %s, want the current item at version 2", content)
+	}
+
+	// a stale If-Match is a failed precondition, and a current one goes through
+	content = alice.expect(http.MethodDelete, "/api/item", map[string]interface{}{"Id": item.Id}, http.StatusPreconditionFailed, "If-Match", `"1"`)
+	expectErrorCode(t, content, "item_version_conflict")
+	alice.expect(http.MethodDelete, "/api/item", map[string]interface{}{"Id": item.Id}, http.StatusOK, "If-Match", `"2"`)
+
+	// leaving the version out altogether is refused
+	item = addTestItem(alice, "Car", 100)
+	content = alice.expect(http.MethodPost, "/api/itemdelete", map[string]interface{}{"Id": item.Id}, http.StatusPreconditionRequired)
+	expectErrorCode(t, content, "item_version_required")
+}
+
+func TestConcurrentUpdatesKeepOneChange(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.login(t, "alice")
+	item := addTestItem(alice, "House", 500)
+
+	// every writer starts from version 1, so only one of them may win
+	const writers = 8
+	statuses := make(chan int, writers)
+	var wait sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wait.Add(1)
+		go func(value int) {
+			defer wait.Done()
+			request, err := http.NewRequest(http.MethodPatch, api.server.URL+"/api/item?id="+strconv.Itoa(item.Id),
+				strings.NewReader(`{"Value":`+strconv.Itoa(value)+`}`))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			request.Header.Set("If-Match", `"1"`)
+			response, err := alice.client.Do(request)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			response.Body.Close()
+			statuses <- response.StatusCode
+		}(1000 + i)
+	}
+	wait.Wait()
+	close(statuses)
+
+	succeeded := 0
+	for status := range statuses {
+		switch status {
+		case http.StatusOK:
+			succeeded++
+		case http.StatusPreconditionFailed:
+		default:
+			t.Errorf("concurrent patch gave %d", status)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("%d patches succeeded, want exactly 1", succeeded)
+	}
+
+	found, err := api.da.FindItemById(context.Background(), item.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Version != 2 {
+		t.Errorf("item at version %d after one change", found.Version)
+	}
+}
+
+func TestItemListsItemsWithoutExchangeRates(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.login(t, "alice")
+	alice.expect(http.MethodPost, "/api/item",
+		map[string]interface{}{"Name": "Flat", "ItemType": ItemTypeAsset, "Value": 100, "Currency": "EUR"}, http.StatusOK)
+	addTestItem(alice, "Cash", 50)
+
+	var list ItemList
+	decodeTestBody(t, alice.expect(http.MethodPost, "/api/itemlist", nil, http.StatusOK), &list)
+	if list.Count != 2 || !list.Incomplete || list.NetWorth != 50 {
+		t.Errorf("list has %d items, incomplete %v and net worth %d, want 2, true and 50", list.Count, list.Incomplete, list.NetWorth)
+	}
+	if !list.Conversions[0].Unconverted || list.Conversions[0].Value != 100 {
+		t.Errorf("EUR item converted as %+v", list.Conversions[0])
+	}
+
+	// snapshots still work, and leave out what they can't count
+	var snapshot SnapshotEntry
+	decodeTestBody(t, alice.expect(http.MethodPost, "/api/snapshot", nil, http.StatusOK), &snapshot)
+	if snapshot.NetWorth != 50 || len(snapshot.Items) != 1 {
+		t.Errorf("snapshot %+v, want net worth 50 and only the USD item", snapshot)
+	}
+}
+
+func TestExchangeRatesCannotBeSetThroughTheAPI(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.login(t, "alice")
+	alice.expect(http.MethodPost, "/api/exchangerates",
+		[]map[string]interface{}{{"Currency": "EUR", "Base": "USD", "Rate": 2, "Date": "2020-01-01"}}, http.StatusMethodNotAllowed)
+
+	rates, err := api.da.GetExchangeRates(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*rates) != 0 {
+		t.Errorf("%d rates were stored", len(*rates))
+	}
+}
+
+func TestItemListRejectsUnknownTypes(t *testing.T) {
+	alice := newTestAPI(t).login(t, "alice")
+	var response ErrorResponse
+	decodeTestBody(t, alice.expect(http.MethodPost, "/api/itemlist?type=Car", nil, http.StatusBadRequest), &response)
+	if response.Code != "invalid_item_type" || !strings.Contains(response.Message, "Must be Asset or Liability") {
+		t.Errorf("unknown type gave %+v, want the reason", response)
+	}
+}
+
+func TestItemListRejectsUnknownCategories(t *testing.T) {
+	alice := newTestAPI(t).login(t, "alice")
+	content := alice.expect(http.MethodPost, "/api/itemlist?category=yachts", nil, http.StatusBadRequest)
+	expectErrorCode(t, content, "invalid_item_category")
+	alice.expect(http.MethodPost, "/api/itemlist?category="+url.QueryEscape(ItemCategoryStudentLoan), nil, http.StatusOK)
+}
+
+// Helper method to add items with repeated names, values and update times, so every order has ties
+func addTestItemsForPaging(t *testing.T, da DataAccess, user *UserEntry) []ItemEntry {
+	t.Helper()
+	items := make([]ItemEntry, 0)
+	for i, entry := range []struct {
+		name     string
+		itemType string
+		value    int64
+	}{
+		{"House", ItemTypeAsset, 500}, {"car", ItemTypeAsset, 300}, {"Car", ItemTypeAsset, 300},
+		{"Loan", ItemTypeLiability, 300}, {"boat", ItemTypeAsset, 700}, {"House", ItemTypeAsset, 100},
+		{"Card", ItemTypeLiability, 50},
+	} {
+		item, err := da.AddItem(context.Background(), &ItemEntry{Uid: user.Id, Name: entry.name, Type: entry.itemType,
+			Category: ItemCategoryOther, Currency: DefaultCurrency, Value: entry.value})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// update times which repeat, like the names and values
+		updated := int64(1600000000 + i%3)
+		sqlDA := da.(DataAccessSQL)
+		if _, err := sqlDA.database.Exec(sqlDA.bind("UPDATE items SET updated_at = $1 WHERE id = $2"), updated, item.Id); err != nil {
+			t.Fatal(err)
+		}
+		item.Updated = time.Unix(updated, 0)
+		items = append(items, *item)
+	}
+	return items
+}
+
+// Helper method to page through a list with the given parameters, giving the ids in the order they came
+func pageTestItems(t *testing.T, da DataAccess, user *UserEntry, values url.Values) []int {
+	t.Helper()
+	ids := make([]int, 0)
+	for pages := 0; ; pages++ {
+		if pages > 20 {
+			t.Fatal("paging never finished")
+		}
+		query, err := parseItemQuery(values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list, err := GetItems(context.Background(), da, user, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, item := range *list.Items {
+			ids = append(ids, item.Id)
+		}
+		if list.NextCursor == "" {
+			return ids
+		}
+		values.Set("cursor", list.NextCursor)
+	}
+}
+
+func TestItemPagingCoversEveryItemOnce(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, da DataAccess) {
+		user := addTestUser(t, da, "alice")
+		items := addTestItemsForPaging(t, da, user)
+
+		keys := map[string]func(a, b *ItemEntry) int{
+			ItemSortId: func(a, b *ItemEntry) int { return 0 },
+			ItemSortName: func(a, b *ItemEntry) int {
+				return strings.Compare(a.Name, b.Name)
+			},
+			ItemSortValue: func(a, b *ItemEntry) int {
+				return int(a.Value - b.Value)
+			},
+			ItemSortUpdated: func(a, b *ItemEntry) int {
+				return int(a.Updated.Unix() - b.Updated.Unix())
+			},
+		}
+		for sortKey, compare := range keys {
+			for _, order := range []string{"asc", "desc"} {
+				// ties fall back on the id, in the same direction
+				expected := append([]ItemEntry(nil), items...)
+				sort.Slice(expected, func(i, j int) bool {
+					less := compare(&expected[i], &expected[j])
+					if less == 0 {
+						less = expected[i].Id - expected[j].Id
+					}
+					if order == "desc" {
+						return less > 0
+					}
+					return less < 0
+				})
+				want := make([]int, 0, len(expected))
+				for _, item := range expected {
+					want = append(want, item.Id)
+				}
+
+				got := pageTestItems(t, da, user, url.Values{"sort": {sortKey}, "order": {order}, "limit": {"2"}})
+				if fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Errorf("sorting by %s %s paged %v, want %v", sortKey, order, got, want)
+				}
+			}
+		}
+	})
+}
+
+func TestItemListTotalsCoverEveryPage(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, da DataAccess) {
+		user := addTestUser(t, da, "alice")
+		addTestItemsForPaging(t, da, user)
+
+		query, err := parseItemQuery(url.Values{"type": {ItemTypeAsset}, "minValue": {"300"}, "sort": {ItemSortValue}, "limit": {"2"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		list, err := GetItems(context.Background(), da, user, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(*list.Items) != 2 || list.NextCursor == "" {
+			t.Errorf("first page has %d items and cursor %q, want 2 and more to come", len(*list.Items), list.NextCursor)
+		}
+		// House at 500, both cars and the boat match, on this page or a later one
+		if list.Count != 4 || list.NetWorth != 1800 || list.AssetTotal != 1800 || list.LiabilityTotal != 0 {
+			t.Errorf("totals over %d items came to %d, want 4 items worth 1800", list.Count, list.NetWorth)
+		}
+		if totals := list.CategoryTotals[ItemCategoryOther]; totals == nil || totals.NetWorth != 1800 {
+			t.Errorf("category totals %+v, want 1800", totals)
+		}
+		if len(list.Conversions) != len(*list.Items) {
+			t.Errorf("%d conversions for a page of %d", len(list.Conversions), len(*list.Items))
+		}
+
+		// the totals and the page are read together, so writes in between can't split them
+		metrics := NewServerMetrics()
+		if _, err := GetItems(context.Background(), InstrumentDataAccess(da, metrics), user, query); err != nil {
+			t.Fatal(err)
+		}
+		if testMetricCount(metrics.dbLatency, "WithTransaction") != 1 || testMetricCount(metrics.dbLatency, "GetItemsByUser") != 2 {
+			t.Error("the items were not read in a single transaction")
+		}
+	})
+}
+
+func TestItemCursorsOnlyContinueTheirOwnOrder(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.login(t, "alice")
+	for _, name := range []string{"House", "Car", "Boat"} {
+		addTestItem(alice, name, 100)
+	}
+
+	var list ItemList
+	decodeTestBody(t, alice.expect(http.MethodPost, "/api/itemlist?sort=name&limit=1", nil, http.StatusOK), &list)
+	if list.NextCursor == "" {
+		t.Fatal("no cursor for the next page")
+	}
+	cursor := url.QueryEscape(list.NextCursor)
+
+	// the same order carries on
+	alice.expect(http.MethodPost, "/api/itemlist?sort=name&limit=1&cursor="+cursor, nil, http.StatusOK)
+
+	for _, parameters := range []string{
+		"sort=value&limit=1&cursor=" + cursor,
+		"sort=name&order=desc&limit=1&cursor=" + cursor,
+		"limit=1&cursor=" + cursor,
+		"sort=name&limit=1&cursor=" + cursor[:len(cursor)-4],
+		"sort=name&limit=1&cursor=" + cursor + "x",
+		"sort=name&limit=1&cursor=not-a-cursor",
+	} {
+		content := alice.expect(http.MethodPost, "/api/itemlist?"+parameters, nil, http.StatusBadRequest)
+		expectErrorCode(t, content, "invalid_item_query")
+	}
+}
+
+func TestItemListTotalsByCategoryAndTag(t *testing.T) {
+	alice := newTestAPI(t).login(t, "alice")
+	for _, item := range []map[string]interface{}{
+		{"Name": "House", "ItemType": ItemTypeAsset, "Category": ItemCategoryRealEstate, "Value": 500, "Tags": []string{"home", "property"}},
+		{"Name": "Cabin", "ItemType": ItemTypeAsset, "Category": ItemCategoryRealEstate, "Value": 200, "Tags": []string{"Home"}},
+		{"Name": "Car", "ItemType": ItemTypeAsset, "Category": ItemCategoryVehicles, "Value": 100, "Tags": []string{"property"}},
+		{"Name": "Mortgage", "ItemType": ItemTypeLiability, "Category": ItemCategoryMortgage, "Value": 300, "Tags": []string{"home"}},
+		{"Name": "Cash", "ItemType": ItemTypeAsset, "Value": 50},
+	} {
+		alice.expect(http.MethodPost, "/api/item", item, http.StatusOK)
+	}
+
+	var list ItemList
+	decodeTestBody(t, alice.expect(http.MethodPost, "/api/itemlist", nil, http.StatusOK), &list)
+	if list.NetWorth != 550 || list.AssetTotal != 850 || list.LiabilityTotal != 300 {
+		t.Errorf("totals %d, %d and %d, want 550, 850 and 300", list.NetWorth, list.AssetTotal, list.LiabilityTotal)
+	}
+
+	// every item is in one category, and items without one are other
+	for category, want := range map[string]ItemTotals{
+		ItemCategoryRealEstate: {NetWorth: 700, AssetTotal: 700},
+		ItemCategoryVehicles:   {NetWorth: 100, AssetTotal: 100},
+		ItemCategoryMortgage:   {NetWorth: -300, LiabilityTotal: 300},
+		ItemCategoryOther:      {NetWorth: 50, AssetTotal: 50},
+	} {
+		if got := list.CategoryTotals[category]; got == nil || *got != want {
+			t.Errorf("%s totals %+v, want %+v", category, got, want)
+		}
+	}
+	if len(list.CategoryTotals) != 4 {
+		t.Errorf("%d categories totalled, want 4", len(list.CategoryTotals))
+	}
+
+	// while an item counts towards each of its tags, which differ by case
+	for tag, want := range map[string]ItemTotals{
+		"home":     {NetWorth: 200, AssetTotal: 500, LiabilityTotal: 300},
+		"Home":     {NetWorth: 200, AssetTotal: 200},
+		"property": {NetWorth: 600, AssetTotal: 600},
+	} {
+		if got := list.TagTotals[tag]; got == nil || *got != want {
+			t.Errorf("%s totals %+v, want %+v", tag, got, want)
+		}
+	}
+	if len(list.TagTotals) != 3 {
+		t.Errorf("%d tags totalled, want 3", len(list.TagTotals))
+	}
+
+	// filtering by category narrows the totals too
+	list = ItemList{}
+	decodeTestBody(t, alice.expect(http.MethodPost, "/api/itemlist?category=real+estate", nil, http.StatusOK), &list)
+	if list.Count != 2 || list.NetWorth != 700 || list.TagTotals["property"].NetWorth != 500 {
+		t.Errorf("real estate list has %d items worth %d, want 2 worth 700", list.Count, list.NetWorth)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// How serious a log message is, messages below the configured level are dropped
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+func (level logLevel) String() string {
+	return [...]string{"debug", "info", "warn", "error"}[level]
+}
+
+const (
+	logFormatLogfmt = "logfmt"
+	logFormatJSON   = "json"
+	// written in place of values which are redacted
+	redactedValue = "[redacted]"
+)
+
+// How log lines are written, set from the config at startup
+var logSettings = struct {
+	minLevel logLevel
+	format   string
+	// whether user identifiers and financial values are left out of the logs
+	redact bool
+}{minLevel: levelInfo, format: logFormatLogfmt}
+
+var (
+	logMutex  sync.Mutex
+	logOutput io.Writer = os.Stdout
+)
+
+// Applies the logging settings of the config
+func configureLogging(config *Config) {
+	logSettings.minLevel = logLevelNames[config.LogLevel]
+	logSettings.format = config.LogFormat
+	logSettings.redact = config.LogRedact
+}
+
+// One key and value of a log line
+type logField struct {
+	key   string
+	value interface{}
+	// user identifiers and financial values, replaced when redaction is on
+	sensitive bool
+}
+
+func field(key string, value interface{}) logField {
+	return logField{key: key, value: value}
+}
+
+// A field which is left out of the logs when redaction is on
+func sensitiveField(key string, value interface{}) logField {
+	return logField{key: key, value: value, sensitive: true}
+}
+
+// The error which caused a message
+// Messages can name users and hold values, our own errors' as well as the database's
+// (a duplicate key names the key), so with redaction on our errors are logged by
+// their code and any others by the type of the error at the root of them
+func errorField(err error) logField {
+	if !logSettings.redact {
+		return field("error", err.Error())
+	}
+	if status, response := describeError(err); status != 500 {
+		return field("error_code", response.Code)
+	}
+
+	root := err
+	for unwrapped := errors.Unwrap(root); unwrapped != nil; unwrapped = errors.Unwrap(root) {
+		root = unwrapped
+	}
+	return field("error_type", fmt.Sprintf("%T", root))
+}
+
+// What is known about the request a log line is written for, see withRequestLog
+type requestLog struct {
+	id string
+	// the logged in user, once RequireUser has found them
+	user string
+}
+
+type requestLogKey struct{}
+
+// Gets the log details of the request a context belongs to, nil outside of a request
+func requestLogFrom(context context.Context) *requestLog {
+	entry, _ := context.Value(requestLogKey{}).(*requestLog)
+	return entry
+}
+
+// Helper method to write a message if its level is high enough
+// Lines written while handling a request are tagged with its id and user
+func logAt(context context.Context, level logLevel, message string, fields []logField) {
+	if level < logSettings.minLevel {
+		return
+	}
+
+	line := []logField{field("time", time.Now().UTC().Format(time.RFC3339Nano)), field("level", level.String()), field("msg", message)}
+	if entry := requestLogFrom(context); entry != nil {
+		line = append(line, field("request_id", entry.id))
+		if entry.user != "" {
+			line = append(line, sensitiveField("user", entry.user))
+		}
+	}
+	line = append(line, fields...)
+
+	var buffer bytes.Buffer
+	if logSettings.format == logFormatJSON {
+		writeJSONLogLine(&buffer, line)
+	} else {
+		writeLogfmtLine(&buffer, line)
+	}
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	logOutput.Write(buffer.Bytes())
+}
+
+// Helper method to give the value of a field as it should be written
+func (f logField) text() string {
+	if f.sensitive && logSettings.redact {
+		return redactedValue
+	}
+	switch value := f.value.(type) {
+	case string:
+		return value
+	case error:
+		return value.Error()
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// Helper method to write a line as key=value pairs, quoting values which need it
+func writeLogfmtLine(buffer *bytes.Buffer, line []logField) {
+	for i, f := range line {
+		if i > 0 {
+			buffer.WriteByte(' ')
+		}
+		buffer.WriteString(f.key + "=")
+
+		text := f.text()
+		if text == "" || strings.IndexFunc(text, func(r rune) bool { return r <= ' ' || r == '=' || r == '"' || !unicode.IsPrint(r) }) >= 0 {
+			text = strconv.Quote(text)
+		}
+		buffer.WriteString(text)
+	}
+	buffer.WriteByte('\n')
+}
+
+// Helper method to write a line as a JSON object, numbers stay numbers
+func writeJSONLogLine(buffer *bytes.Buffer, line []logField) {
+	buffer.WriteByte('{')
+	for i, f := range line {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		key, _ := json.Marshal(f.key)
+		buffer.Write(key)
+		buffer.WriteByte(':')
+
+		var value interface{} = f.text()
+		switch f.value.(type) {
+		case int, int64, float64, bool:
+			if !f.sensitive || !logSettings.redact {
+				value = f.value
+			}
+		}
+		encoded, _ := json.Marshal(value)
+		buffer.Write(encoded)
+	}
+	buffer.WriteString("}\n")
+}
+
+// Details which are only useful when tracking down a problem
+func logDebug(context context.Context, message string, fields ...logField) {
+	logAt(context, levelDebug, message, fields)
+}
+
+// The normal running of the server
+func logInfo(context context.Context, message string, fields ...logField) {
+	logAt(context, levelInfo, message, fields)
+}
+
+// Requests which failed because of something the client did
+func logWarn(context context.Context, message string, fields ...logField) {
+	logAt(context, levelWarn, message, fields)
+}
+
+// Failures on our end which someone should look into
+func logError(context context.Context, message string, fields ...logField) {
+	logAt(context, levelError, message, fields)
+}
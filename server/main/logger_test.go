@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Helper method to turn redaction on or off for a test, and capture what is logged
+func captureTestLogs(t *testing.T, redact bool, format string) *bytes.Buffer {
+	t.Helper()
+	previous := logSettings
+	var output bytes.Buffer
+	logSettings.redact, logSettings.format, logOutput = redact, format, &output
+	t.Cleanup(func() {
+		logSettings, logOutput = previous, ioutil.Discard
+	})
+	return &output
+}
+
+func TestErrorFieldRedaction(t *testing.T) {
+	duplicate := errors.New("Error 1062: Duplicate entry 'alice' for key 'users.name'")
+	wrapped := &MigrationFailedError{Version: 2, Err: duplicate}
+	ours := &UserAlreadyExistsError{Name: "alice"}
+
+	captureTestLogs(t, false, logFormatLogfmt)
+	if f := errorField(wrapped); f.key != "error" || !strings.Contains(f.text(), "alice") {
+		t.Errorf("without redaction logged %s=%s, want the whole message", f.key, f.text())
+	}
+
+	captureTestLogs(t, true, logFormatLogfmt)
+	for _, test := range []struct {
+		err   error
+		key   string
+		value string
+	}{
+		{ours, "error_code", "user_already_exists"},
+		{duplicate, "error_type", "*errors.errorString"},
+		{wrapped, "error_type", "*errors.errorString"},
+	} {
+		if f := errorField(test.err); f.key != test.key || f.text() != test.value {
+			t.Errorf("%v logged as %s=%s, want %s=%s", test.err, f.key, f.text(), test.key, test.value)
+		}
+	}
+}
+
+func TestRedactedLogLines(t *testing.T) {
+	for _, format := range []string{logFormatLogfmt, logFormatJSON} {
+		output := captureTestLogs(t, true, format)
+		request := &requestLog{id: "abc", user: "alice"}
+		ctx := context.WithValue(context.Background(), requestLogKey{}, request)
+		logInfo(ctx, "Added item", sensitiveField("value", int64(50000)), field("item", 7),
+			errorField(errors.New("Duplicate entry 'alice'")))
+
+		line := output.String()
+		if strings.Contains(line, "alice") || strings.Contains(line, "50000") {
+			t.Errorf("%s line gave away the user or value: %s", format, line)
+		}
+		if !strings.Contains(line, "abc") || !strings.Contains(line, "7") || !strings.Contains(line, redactedValue) {
+			t.Errorf("%s line lost what isn't sensitive: %s", format, line)
+		}
+	}
+}
+
+func TestRequestLogPathRedaction(t *testing.T) {
+	paths := map[string]string{
+		"/api/v2/users/alice/items?limit=2": "/api/v2/users/" + redactedValue + "/items",
+		"/api/v2/users/alice":               "/api/v2/users/" + redactedValue,
+		"/api/v2/items/7":                   "/api/v2/items/7",
+		"/api/itemlist?name=alice":          "/api/itemlist",
+	}
+
+	captureTestLogs(t, true, logFormatLogfmt)
+	for path, want := range paths {
+		if got := requestLogPath(httptest.NewRequest("GET", path, nil)); got != want {
+			t.Errorf("%s logged as %s, want %s", path, got, want)
+		}
+	}
+
+	captureTestLogs(t, false, logFormatLogfmt)
+	if got := requestLogPath(httptest.NewRequest("GET", "/api/v2/users/alice/items", nil)); got != "/api/v2/users/alice/items" {
+		t.Errorf("without redaction logged %s", got)
+	}
+}
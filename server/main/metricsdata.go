@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+const (
+	countRecordsCommand = `
+SELECT (SELECT COUNT(*) FROM users), (SELECT COUNT(*) FROM items), (SELECT COUNT(*) FROM snapshots)
+`
+)
+
+// How much is stored, across every user
+type RecordCounts struct {
+	Users     int
+	Items     int
+	Snapshots int
+}
+
+func (da DataAccessSQL) CountRecords(context context.Context) (*RecordCounts, error) {
+	var counts RecordCounts
+	err := da.runner().QueryRowContext(context, da.bind(countRecordsCommand)).Scan(&counts.Users, &counts.Items, &counts.Snapshots)
+	if err != nil {
+		return nil, err
+	}
+	return &counts, nil
+}
+
+// Wraps a DataAccess to time every operation and count the ones which fail
+type metricsDataAccess struct {
+	inner   DataAccess
+	metrics *ServerMetrics
+}
+
+func InstrumentDataAccess(da DataAccess, metrics *ServerMetrics) DataAccess {
+	return metricsDataAccess{inner: da, metrics: metrics}
+}
+
+// Helper method to record an operation once it has finished, deferred with the operation's error
+// Errors which only tell the client something, like a missing item or a version conflict, are
+// expected and not counted, only the ones we would respond to with a 5xx other than timeouts
+func (da metricsDataAccess) observe(context context.Context, operation string, start time.Time, err *error) {
+	da.metrics.dbLatency.observe(time.Since(start).Seconds(), operation)
+	if *err == nil {
+		return
+	}
+	// requests which ran out of time or were abandoned aren't the database failing, drivers
+	// don't always wrap the context's error so the context itself is checked too
+	if context.Err() != nil {
+		return
+	}
+	if status, response := describeError(*err); status >= http.StatusInternalServerError &&
+		response.Code != "timeout" && response.Code != "cancelled" {
+		da.metrics.dbErrors.inc(operation)
+	}
+}
+
+func (da metricsDataAccess) Close() {
+	da.inner.Close()
+}
+
+func (da metricsDataAccess) Standup(context context.Context) (err error) {
+	defer da.observe(context, "Standup", time.Now(), &err)
+	return da.inner.Standup(context)
+}
+
+func (da metricsDataAccess) Ping(context context.Context) (err error) {
+	defer da.observe(context, "Ping", time.Now(), &err)
+	return da.inner.Ping(context)
+}
+
+func (da metricsDataAccess) WithTransaction(context context.Context, work func(DataAccess) error) (err error) {
+	defer da.observe(context, "WithTransaction", time.Now(), &err)
+	// the work is measured too, so hand it an instrumented DataAccess
+	return da.inner.WithTransaction(context, func(tx DataAccess) error {
+		return work(metricsDataAccess{inner: tx, metrics: da.metrics})
+	})
+}
+
+func (da metricsDataAccess) Migrate(context context.Context, target int) (err error) {
+	defer da.observe(context, "Migrate", time.Now(), &err)
+	return da.inner.Migrate(context, target)
+}
+
+func (da metricsDataAccess) GetMigrations(context context.Context) (migrations *[]MigrationEntry, err error) {
+	defer da.observe(context, "GetMigrations", time.Now(), &err)
+	return da.inner.GetMigrations(context)
+}
+
+func (da metricsDataAccess) GetSchemaVersion(context context.Context) (current int, latest int, err error) {
+	defer da.observe(context, "GetSchemaVersion", time.Now(), &err)
+	return da.inner.GetSchemaVersion(context)
+}
+
+func (da metricsDataAccess) CountRecords(context context.Context) (counts *RecordCounts, err error) {
+	defer da.observe(context, "CountRecords", time.Now(), &err)
+	return da.inner.CountRecords(context)
+}
+
+func (da metricsDataAccess) AddUser(context context.Context, username string, passwordHash string) (err error) {
+	defer da.observe(context, "AddUser", time.Now(), &err)
+	return da.inner.AddUser(context, username, passwordHash)
+}
+
+func (da metricsDataAccess) FindUserByName(context context.Context, username string) (user *UserEntry, err error) {
+	defer da.observe(context, "FindUserByName", time.Now(), &err)
+	return da.inner.FindUserByName(context, username)
+}
+
+func (da metricsDataAccess) FindUserById(context context.Context, uid int) (user *UserEntry, err error) {
+	defer da.observe(context, "FindUserById", time.Now(), &err)
+	return da.inner.FindUserById(context, uid)
+}
+
+func (da metricsDataAccess) GetUsers(context context.Context) (users *[]UserEntry, err error) {
+	defer da.observe(context, "GetUsers", time.Now(), &err)
+	return da.inner.GetUsers(context)
+}
+
+func (da metricsDataAccess) UpdateUser(context context.Context, user *UserEntry) (err error) {
+	defer da.observe(context, "UpdateUser", time.Now(), &err)
+	return da.inner.UpdateUser(context, user)
+}
+
+func (da metricsDataAccess) SetPasswordHash(context context.Context, uid int, passwordHash string) (err error) {
+	defer da.observe(context, "SetPasswordHash", time.Now(), &err)
+	return da.inner.SetPasswordHash(context, uid, passwordHash)
+}
+
+func (da metricsDataAccess) DeleteUser(context context.Context, uid int) (err error) {
+	defer da.observe(context, "DeleteUser", time.Now(), &err)
+	return da.inner.DeleteUser(context, uid)
+}
+
+func (da metricsDataAccess) AddSession(context context.Context, tokenHash string, uid int, expires int64) (err error) {
+	defer da.observe(context, "AddSession", time.Now(), &err)
+	return da.inner.AddSession(context, tokenHash, uid, expires)
+}
+
+func (da metricsDataAccess) FindSession(context context.Context, tokenHash string) (session *SessionEntry, err error) {
+	defer da.observe(context, "FindSession", time.Now(), &err)
+	return da.inner.FindSession(context, tokenHash)
+}
+
+func (da metricsDataAccess) DeleteSession(context context.Context, tokenHash string) (err error) {
+	defer da.observe(context, "DeleteSession", time.Now(), &err)
+	return da.inner.DeleteSession(context, tokenHash)
+}
+
+func (da metricsDataAccess) DeleteExpiredSessions(context context.Context, now int64) (err error) {
+	defer da.observe(context, "DeleteExpiredSessions", time.Now(), &err)
+	return da.inner.DeleteExpiredSessions(context, now)
+}
+
+func (da metricsDataAccess) DeleteUserSessions(context context.Context, userid int) (err error) {
+	defer da.observe(context, "DeleteUserSessions", time.Now(), &err)
+	return da.inner.DeleteUserSessions(context, userid)
+}
+
+func (da metricsDataAccess) AddItem(context context.Context, item *ItemEntry) (stored *ItemEntry, err error) {
+	defer da.observe(context, "AddItem", time.Now(), &err)
+	return da.inner.AddItem(context, item)
+}
+
+func (da metricsDataAccess) AddItems(context context.Context, items *[]ItemEntry) (err error) {
+	defer da.observe(context, "AddItems", time.Now(), &err)
+	return da.inner.AddItems(context, items)
+}
+
+func (da metricsDataAccess) UpdateItem(context context.Context, item *ItemEntry) (stored *ItemEntry, err error) {
+	defer da.observe(context, "UpdateItem", time.Now(), &err)
+	return da.inner.UpdateItem(context, item)
+}
+
+func (da metricsDataAccess) DeleteItem(context context.Context, id int, version int) (err error) {
+	defer da.observe(context, "DeleteItem", time.Now(), &err)
+	return da.inner.DeleteItem(context, id, version)
+}
+
+func (da metricsDataAccess) GetItemsByUser(context context.Context, uid int, query *ItemQuery) (items *[]ItemEntry, err error) {
+	defer da.observe(context, "GetItemsByUser", time.Now(), &err)
+	return da.inner.GetItemsByUser(context, uid, query)
+}
+
+func (da metricsDataAccess) FindItemById(context context.Context, id int) (item *ItemEntry, err error) {
+	defer da.observe(context, "FindItemById", time.Now(), &err)
+	return da.inner.FindItemById(context, id)
+}
+
+func (da metricsDataAccess) GetItemHistory(context context.Context, id int) (history *[]ItemValueEntry, err error) {
+	defer da.observe(context, "GetItemHistory", time.Now(), &err)
+	return da.inner.GetItemHistory(context, id)
+}
+
+func (da metricsDataAccess) SetExchangeRate(context context.Context, rate *ExchangeRateEntry) (err error) {
+	defer da.observe(context, "SetExchangeRate", time.Now(), &err)
+	return da.inner.SetExchangeRate(context, rate)
+}
+
+func (da metricsDataAccess) GetExchangeRates(context context.Context) (rates *[]ExchangeRateEntry, err error) {
+	defer da.observe(context, "GetExchangeRates", time.Now(), &err)
+	return da.inner.GetExchangeRates(context)
+}
+
+func (da metricsDataAccess) AddSnapshot(context context.Context, snapshot *SnapshotEntry) (id int, err error) {
+	defer da.observe(context, "AddSnapshot", time.Now(), &err)
+	return da.inner.AddSnapshot(context, snapshot)
+}
+
+func (da metricsDataAccess) GetSnapshotsByUser(context context.Context, uid int, from time.Time, to time.Time) (snapshots *[]SnapshotEntry, err error) {
+	defer da.observe(context, "GetSnapshotsByUser", time.Now(), &err)
+	return da.inner.GetSnapshotsByUser(context, uid, from, to)
+}
+
+func (da metricsDataAccess) GetLatestSnapshotTime(context context.Context, uid int, before time.Time) (taken time.Time, err error) {
+	defer da.observe(context, "GetLatestSnapshotTime", time.Now(), &err)
+	return da.inner.GetLatestSnapshotTime(context, uid, before)
+}
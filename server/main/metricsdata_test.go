@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Helper method to read a counter's value, or how many values a histogram has observed
+func testMetricCount(family *metricFamily, values ...string) float64 {
+	family.mutex.Lock()
+	defer family.mutex.Unlock()
+	if series, ok := family.series[strings.Join(values, "\xff")]; ok {
+		return series.count
+	}
+	return 0
+}
+
+func TestInstrumentedDataAccess(t *testing.T) {
+	inner := openTestDataAccess(t, sqliteDialect.driver, filepath.Join(t.TempDir(), "test.db"), false)
+	metrics := NewServerMetrics()
+	da := InstrumentDataAccess(inner, metrics)
+	addTestUser(t, da, "alice")
+
+	if testMetricCount(metrics.dbLatency, "AddUser") != 1 || testMetricCount(metrics.dbLatency, "FindUserByName") == 0 {
+		t.Error("operations were not timed")
+	}
+
+	// operations run as part of a transaction are timed along with it
+	err := da.WithTransaction(context.Background(), func(tx DataAccess) error {
+		_, err := tx.GetUsers(context.Background())
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if testMetricCount(metrics.dbLatency, "WithTransaction") != 1 || testMetricCount(metrics.dbLatency, "GetUsers") != 1 {
+		t.Error("the transaction and its work were not both timed")
+	}
+
+	// a conflict is the client's doing, so it isn't counted as a failure
+	if err := da.DeleteItem(context.Background(), 999, 1); err == nil {
+		t.Fatal("deleting a missing item succeeded")
+	}
+	if testMetricCount(metrics.dbErrors, "DeleteItem") != 0 {
+		t.Error("a version conflict was counted as a database error")
+	}
+
+	// nor is running out of time
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := da.GetUsers(cancelled); err == nil {
+		t.Fatal("a cancelled query succeeded")
+	}
+	if testMetricCount(metrics.dbErrors, "GetUsers") != 0 {
+		t.Error("a cancelled query was counted as a database error")
+	}
+
+	// but the database itself failing is
+	inner.Close()
+	if _, err := da.GetUsers(context.Background()); err == nil {
+		t.Fatal("a query on a closed database succeeded")
+	}
+	if testMetricCount(metrics.dbErrors, "GetUsers") != 1 {
+		t.Error("a failed query was not counted")
+	}
+	if testMetricCount(metrics.dbLatency, "GetUsers") != 3 {
+		t.Errorf("GetUsers timed %v times, want every call", testMetricCount(metrics.dbLatency, "GetUsers"))
+	}
+}
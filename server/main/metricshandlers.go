@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Latency buckets in seconds, the same defaults the Prometheus client libraries use
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// A counter or histogram, split into one series for each combination of its label values
+type metricFamily struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	mutex  sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	values []string
+	// the counter's value, or how many values a histogram has observed
+	count float64
+	sum   float64
+	// observations falling in each of the latency buckets, histograms only
+	buckets []uint64
+}
+
+func newMetricFamily(name string, help string, kind string, labels ...string) *metricFamily {
+	return &metricFamily{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*metricSeries)}
+}
+
+// Helper method to find the series for some label values, making it if this is the first time
+// The family must be locked
+func (family *metricFamily) find(values []string) *metricSeries {
+	key := strings.Join(values, "\xff")
+	series, ok := family.series[key]
+	if !ok {
+		series = &metricSeries{values: values}
+		if family.kind == "histogram" {
+			series.buckets = make([]uint64, len(latencyBuckets))
+		}
+		family.series[key] = series
+	}
+	return series
+}
+
+// Adds one to a counter
+func (family *metricFamily) inc(values ...string) {
+	family.mutex.Lock()
+	defer family.mutex.Unlock()
+	family.find(values).count++
+}
+
+// Records a value, in seconds, in a histogram
+func (family *metricFamily) observe(seconds float64, values ...string) {
+	family.mutex.Lock()
+	defer family.mutex.Unlock()
+	series := family.find(values)
+	series.count++
+	series.sum += seconds
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			series.buckets[i]++
+			break
+		}
+	}
+}
+
+// Writes every series of the family in the Prometheus text format, sorted so scrapes are stable
+func (family *metricFamily) write(writer io.Writer) {
+	family.mutex.Lock()
+	defer family.mutex.Unlock()
+
+	keys := make([]string, 0, len(family.series))
+	for key := range family.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buffer bytes.Buffer
+	buffer.WriteString("# HELP " + family.name + " " + family.help + "\n")
+	buffer.WriteString("# TYPE " + family.name + " " + family.kind + "\n")
+	for _, key := range keys {
+		series := family.series[key]
+		if family.kind != "histogram" {
+			buffer.WriteString(family.name + formatLabels(family.labels, series.values) + " " + formatMetricValue(series.count) + "\n")
+			continue
+		}
+
+		// buckets are cumulative, each counts everything at or below its bound
+		names := append(append([]string{}, family.labels...), "le")
+		values := append(append([]string{}, series.values...), "")
+		cumulative := uint64(0)
+		for i, bound := range latencyBuckets {
+			cumulative += series.buckets[i]
+			values[len(values)-1] = formatMetricValue(bound)
+			buffer.WriteString(family.name + "_bucket" + formatLabels(names, values) + " " + strconv.FormatUint(cumulative, 10) + "\n")
+		}
+		values[len(values)-1] = "+Inf"
+		labels := formatLabels(names, values)
+		buffer.WriteString(family.name + "_bucket" + labels + " " + formatMetricValue(series.count) + "\n")
+		buffer.WriteString(family.name + "_sum" + formatLabels(family.labels, series.values) + " " + formatMetricValue(series.sum) + "\n")
+		buffer.WriteString(family.name + "_count" + formatLabels(family.labels, series.values) + " " + formatMetricValue(series.count) + "\n")
+	}
+	writer.Write(buffer.Bytes())
+}
+
+// Writes a single value which is measured when scraped
+func writeGauge(writer io.Writer, name string, help string, value float64) {
+	io.WriteString(writer, "# HELP "+name+" "+help+"\n# TYPE "+name+" gauge\n"+name+" "+formatMetricValue(value)+"\n")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Helper method to write labels as {name="value",...}
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i := range names {
+		pairs[i] = names[i] + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Everything the server measures about itself
+type ServerMetrics struct {
+	requests  *metricFamily
+	latency   *metricFamily
+	dbLatency *metricFamily
+	dbErrors  *metricFamily
+}
+
+func NewServerMetrics() *ServerMetrics {
+	return &ServerMetrics{
+		requests: newMetricFamily("worthtracker_http_requests_total",
+			"HTTP requests handled, by route, method and status code.", "counter", "route", "method", "code"),
+		latency: newMetricFamily("worthtracker_http_request_duration_seconds",
+			"How long HTTP requests took to handle, by route and method.", "histogram", "route", "method"),
+		dbLatency: newMetricFamily("worthtracker_db_operation_duration_seconds",
+			"How long database operations took, by DataAccess method.", "histogram", "operation"),
+		dbErrors: newMetricFamily("worthtracker_db_operation_errors_total",
+			"Database operations which failed on our end, by DataAccess method.", "counter", "operation"),
+	}
+}
+
+// Captures the status a handler responds with, which is 200 unless it says otherwise
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	// only the first status is sent, later ones are ignored
+	if !recorder.wroteHeader {
+		recorder.status = status
+		recorder.wroteHeader = true
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(data []byte) (int, error) {
+	recorder.wroteHeader = true
+	return recorder.ResponseWriter.Write(data)
+}
+
+// Only these methods get their own label, anything else would let clients make endless series
+var metricMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodOptions: true,
+}
+
+// Wraps the server's handler to count and time every request
+// Requests are labelled by the pattern of the route which served them rather than the path,
+// so that e.g. each item id under /api/v2/ doesn't become a series of its own
+func (metrics *ServerMetrics) Instrument(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, route := mux.Handler(request)
+		if route == "" {
+			route = "unmatched"
+		}
+		method := request.Method
+		if !metricMethods[method] {
+			method = "other"
+		}
+
+		recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(recorder, request)
+
+		metrics.latency.observe(time.Since(start).Seconds(), route, method)
+		metrics.requests.inc(route, method, strconv.Itoa(recorder.status))
+	})
+}
+
+type metricsHandlers struct {
+	da      DataAccess
+	metrics *ServerMetrics
+}
+
+// Handles scrapes of the server's metrics in the Prometheus text format
+// Like the probes this needs no session, so limit who can reach it at the network instead
+func (mh metricsHandlers) MetricsRequestHandler(writer http.ResponseWriter, request *http.Request) {
+	if !probeMethodAllowed(writer, request) {
+		return
+	}
+
+	writer.Header().Set("Content-Type", metricsContentType)
+	writer.Header().Set("Cache-Control", "no-store")
+	for _, family := range []*metricFamily{mh.metrics.requests, mh.metrics.latency, mh.metrics.dbLatency, mh.metrics.dbErrors} {
+		family.write(writer)
+	}
+
+	// the rest of the scrape is still useful when the database can't be counted
+	counts, err := mh.da.CountRecords(request.Context())
+	if err != nil {
+		logWarn(request.Context(), "Failed to count records for metrics", errorField(err))
+		return
+	}
+	writeGauge(writer, "worthtracker_users", "Registered users.", float64(counts.Users))
+	writeGauge(writer, "worthtracker_items", "Items across every user.", float64(counts.Items))
+	writeGauge(writer, "worthtracker_snapshots", "Net worth snapshots across every user.", float64(counts.Snapshots))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetricFamilyFormat(t *testing.T) {
+	counter := newMetricFamily("test_total", "A counter.", "counter", "route", "code")
+	counter.inc("/b", "200")
+	counter.inc("/a", "500")
+	counter.inc("/a", "500")
+	counter.inc(`quote" slash\ line`+"\n", "200")
+
+	var output bytes.Buffer
+	counter.write(&output)
+	want := `# HELP test_total A counter.
+# TYPE test_total counter
+test_total{route="/a",code="500"} 2
+test_total{route="/b",code="200"} 1
+test_total{route="quote\" slash\\ line\n",code="200"} 1
+`
+	if output.String() != want {
+		t.Errorf("counter written as\n%s\nwant\n%s", output.String(), want)
+	}
+
+	histogram := newMetricFamily("test_seconds", "A histogram.", "histogram", "operation")
+	histogram.observe(0.003, "Ping")
+	histogram.observe(0.2, "Ping")
+	histogram.observe(20, "Ping")
+
+	output.Reset()
+	histogram.write(&output)
+	want = `# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{operation="Ping",le="0.005"} 1
+test_seconds_bucket{operation="Ping",le="0.01"} 1
+test_seconds_bucket{operation="Ping",le="0.025"} 1
+test_seconds_bucket{operation="Ping",le="0.05"} 1
+test_seconds_bucket{operation="Ping",le="0.1"} 1
+test_seconds_bucket{operation="Ping",le="0.25"} 2
+test_seconds_bucket{operation="Ping",le="0.5"} 2
+test_seconds_bucket{operation="Ping",le="1"} 2
+test_seconds_bucket{operation="Ping",le="2.5"} 2
+test_seconds_bucket{operation="Ping",le="5"} 2
+test_seconds_bucket{operation="Ping",le="10"} 2
+test_seconds_bucket{operation="Ping",le="+Inf"} 3
+test_seconds_sum{operation="Ping"} 20.203
+test_seconds_count{operation="Ping"} 3
+`
+	if output.String() != want {
+		t.Errorf("histogram written as\n%s\nwant\n%s", output.String(), want)
+	}
+}
+
+func TestMetricsScrape(t *testing.T) {
+	api := newTestAPI(t)
+	client := api.login(t, "alice")
+	client.expect(http.MethodGet, "/api/user", nil, http.StatusOK)
+	client.expect(http.MethodGet, "/api/user", nil, http.StatusOK)
+	// every item is counted under the route which served it, and odd methods are lumped together
+	client.expect(http.MethodGet, "/api/v2/items/1", nil, http.StatusNotFound)
+	client.expect(http.MethodGet, "/api/v2/items/2", nil, http.StatusNotFound)
+	client.expect("BREW", "/api/user", nil, http.StatusMethodNotAllowed)
+	client.expect(http.MethodGet, "/nowhere", nil, http.StatusNotFound)
+
+	response, content := client.do(http.MethodGet, "/metrics", nil)
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != metricsContentType {
+		t.Fatalf("scrape gave %d with content type %q", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+	scrape := string(content)
+	for _, line := range []string{
+		`worthtracker_http_requests_total{route="/api/user",method="GET",code="200"} 2`,
+		`worthtracker_http_requests_total{route="/api/user",method="POST",code="200"} 1`,
+		`worthtracker_http_requests_total{route="/api/v2/",method="GET",code="404"} 2`,
+		`worthtracker_http_requests_total{route="/api/user",method="other",code="405"} 1`,
+		`worthtracker_http_requests_total{route="unmatched",method="GET",code="404"} 1`,
+		`worthtracker_http_request_duration_seconds_count{route="/api/user",method="GET"} 2`,
+		`# TYPE worthtracker_db_operation_duration_seconds histogram`,
+		`worthtracker_db_operation_duration_seconds_count{operation="GetUsers"} 2`,
+		`# TYPE worthtracker_db_operation_errors_total counter`,
+		"worthtracker_users 1\n",
+		"worthtracker_items 0\n",
+		"worthtracker_snapshots 0\n",
+	} {
+		if !strings.Contains(scrape, line) {
+			t.Errorf("scrape is missing %s:\n%s", line, scrape)
+		}
+	}
+	if strings.Contains(scrape, "items/1") {
+		t.Error("item paths became series of their own")
+	}
+}
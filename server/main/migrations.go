@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+)
+
+// Every change to the schema is a numbered migration, applied in order and
+// recorded in schema_migrations so it is only ever applied once
+// Never edit a migration which has shipped, add a new one instead
+type migration struct {
+	version     int
+	description string
+	// run in order inside a single transaction
+	// (MySQL commits DDL implicitly, so there a failed step may be left half applied)
+	statements []string
+	// run with foreign key enforcement switched off, which SQLite needs to rebuild a table
+	// that other tables reference without cascading the drop into them
+	withoutForeignKeys bool
+}
+
+const (
+	standupMigrationsCommand = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
+	applied BIGINT NOT NULL
+)`
+	insertMigrationCommand = `
+INSERT INTO schema_migrations (version, applied) VALUES ($1, $2)
+`
+	getMigrationsCommand = `
+SELECT version, applied FROM schema_migrations ORDER BY version
+`
+	getSchemaVersionCommand = `
+SELECT COALESCE(MAX(version), 0) FROM schema_migrations
+`
+)
+
+// The state of a single migration in the database
+type MigrationEntry struct {
+	Version     int
+	Description string
+	// nil when the migration has not been applied yet
+	Applied *time.Time
+}
+
+type MigrationTargetError struct {
+	Target  int
+	Current int
+	Latest  int
+}
+
+func (err *MigrationTargetError) Error() string {
+	if err.Target < err.Current {
+		return "Cannot migrate down to version " + strconv.Itoa(err.Target) + ", the database is already at version " + strconv.Itoa(err.Current) + "."
+	}
+	return "Cannot migrate to version " + strconv.Itoa(err.Target) + ", the latest version is " + strconv.Itoa(err.Latest) + "."
+}
+
+type MigrationFailedError struct {
+	Version int
+	Err     error
+}
+
+func (err *MigrationFailedError) Error() string {
+	return "Migration " + strconv.Itoa(err.Version) + " failed: " + err.Err.Error()
+}
+
+func (err *MigrationFailedError) Unwrap() error {
+	return err.Err
+}
+
+// Gets the highest version in a list of migrations
+func latestMigration(migrations []migration) int {
+	latest := 0
+	for _, m := range migrations {
+		if m.version > latest {
+			latest = m.version
+		}
+	}
+	return latest
+}
+
+// Gets every known migration along with when it was applied, if it has been
+func (da DataAccessSQL) GetMigrations(context context.Context) (*[]MigrationEntry, error) {
+	applied, err := da.getAppliedMigrations(context)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]MigrationEntry, 0, len(da.dialect.migrations))
+	for _, m := range da.dialect.migrations {
+		entry := MigrationEntry{Version: m.version, Description: m.description}
+		if when, ok := applied[m.version]; ok {
+			entry.Applied = &when
+		}
+		entries = append(entries, entry)
+	}
+	return &entries, nil
+}
+
+// Gets the schema version the database is at, along with the latest one this build knows of
+func (da DataAccessSQL) GetSchemaVersion(context context.Context) (int, int, error) {
+	var current int
+	err := da.database.QueryRowContext(context, da.bind(getSchemaVersionCommand)).Scan(&current)
+	if err != nil {
+		return 0, 0, err
+	}
+	return current, latestMigration(da.dialect.migrations), nil
+}
+
+// Applies every pending migration up to and including the target version
+// Migrating down is not supported
+func (da DataAccessSQL) Migrate(context context.Context, target int) error {
+	applied, err := da.getAppliedMigrations(context)
+	if err != nil {
+		return err
+	}
+
+	current := 0
+	for version := range applied {
+		if version > current {
+			current = version
+		}
+	}
+	latest := latestMigration(da.dialect.migrations)
+	if target < current || target > latest {
+		return &MigrationTargetError{Target: target, Current: current, Latest: latest}
+	}
+
+	for _, m := range da.dialect.migrations {
+		if _, ok := applied[m.version]; ok || m.version > target {
+			continue
+		}
+		if err := da.applyMigration(context, m); err != nil {
+			return &MigrationFailedError{Version: m.version, Err: err}
+		}
+	}
+	return nil
+}
+
+// Helper method to run one migration and record it, all in one transaction
+func (da DataAccessSQL) applyMigration(context context.Context, m migration) error {
+	// enforcement is a setting of the connection, so keep hold of one for the whole migration
+	conn, err := da.database.Conn(context)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if m.withoutForeignKeys {
+		// this can't be changed inside a transaction, so it has to happen first
+		if _, err := conn.ExecContext(context, da.dialect.foreignKeysOff); err != nil {
+			return err
+		}
+		// the connection goes back to the pool afterwards, so turn it back on
+		defer conn.ExecContext(context, da.dialect.foreignKeysOn)
+	}
+
+	tx, err := conn.BeginTx(context, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range m.statements {
+		if _, err := tx.ExecContext(context, statement); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(context, da.bind(insertMigrationCommand), m.version, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Helper method to find out which migrations have been applied, and when
+func (da DataAccessSQL) getAppliedMigrations(context context.Context) (map[int]time.Time, error) {
+	// the bookkeeping table is the one thing which can't be a migration itself
+	if _, err := da.database.ExecContext(context, standupMigrationsCommand); err != nil {
+		return nil, err
+	}
+
+	rows, err := da.database.QueryContext(context, da.bind(getMigrationsCommand))
+	// make sure to clean up rows when we're finished
+	defer func() {
+		if rows != nil {
+			rows.Close()
+		}
+	}()
+
+	applied := make(map[int]time.Time)
+	if err == sql.ErrNoRows {
+		return applied, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		// check for errors
+		err = rows.Err()
+		if err != nil {
+			return nil, err
+		}
+
+		// scan the next row
+		var version int
+		var when int64
+		err = rows.Scan(&version, &when)
+		if err != nil {
+			return nil, err
+		}
+
+		applied[version] = time.Unix(when, 0)
+	}
+
+	return applied, nil
+}
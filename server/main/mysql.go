@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// ER_DUP_ENTRY, a value is already in a UNIQUE column
+const mysqlDuplicateEntry = 1062
+
+// MySQL needs explicit AUTO_INCREMENT keys, bounded VARCHARs for anything
+// indexed, and table level FOREIGN KEY clauses (it ignores inline REFERENCES)
+// The driver also only accepts one statement per Exec
+var mysqlDialect = sqlDialect{
+	driver:          "mysql",
+	positional:      true,
+	foreignKeysOff:  "SET FOREIGN_KEY_CHECKS = 0",
+	foreignKeysOn:   "SET FOREIGN_KEY_CHECKS = 1",
+	uniqueViolation: mysqlUniqueViolation,
+	migrations: []migration{
+		{
+			version:     1,
+			description: "create users and items",
+			statements: []string{`
+CREATE TABLE IF NOT EXISTS users (
+	uid  INTEGER PRIMARY KEY AUTO_INCREMENT,
+	name VARCHAR(64) UNIQUE
+) ENGINE=InnoDB`, `
+CREATE TABLE IF NOT EXISTS items (
+	id    INTEGER PRIMARY KEY AUTO_INCREMENT,
+	uid   INTEGER NOT NULL,
+	name  TEXT,
+	type  VARCHAR(16),
+	value BIGINT
+) ENGINE=InnoDB`,
+			},
+		},
+		{
+			version:     2,
+			description: "add passwords and sessions",
+			statements: []string{`
+ALTER TABLE users ADD COLUMN password_hash TEXT`, `
+CREATE TABLE sessions (
+	token_hash CHAR(64) PRIMARY KEY,
+	uid        INTEGER NOT NULL,
+	expires    BIGINT NOT NULL,
+	FOREIGN KEY (uid) REFERENCES users(uid) ON DELETE CASCADE
+) ENGINE=InnoDB`,
+			},
+		},
+		{
+			version:     3,
+			description: "add net worth snapshots",
+			statements: []string{`
+CREATE TABLE snapshots (
+	id              INTEGER PRIMARY KEY AUTO_INCREMENT,
+	uid             INTEGER NOT NULL,
+	taken           BIGINT NOT NULL,
+	net_worth       BIGINT,
+	asset_total     BIGINT,
+	liability_total BIGINT,
+	FOREIGN KEY (uid) REFERENCES users(uid) ON DELETE CASCADE
+) ENGINE=InnoDB`, `
+CREATE TABLE snapshot_items (
+	snapshot_id INTEGER NOT NULL,
+	item_id     INTEGER NOT NULL,
+	name        TEXT,
+	type        VARCHAR(16),
+	value       BIGINT,
+	FOREIGN KEY (snapshot_id) REFERENCES snapshots(id) ON DELETE CASCADE
+) ENGINE=InnoDB`,
+			},
+		},
+		{
+			version:     4,
+			description: "add item value history",
+			statements: []string{`
+CREATE TABLE item_values (
+	id       INTEGER PRIMARY KEY AUTO_INCREMENT,
+	item_id  INTEGER NOT NULL,
+	value    BIGINT,
+	recorded BIGINT NOT NULL,
+	FOREIGN KEY (item_id) REFERENCES items(id) ON DELETE CASCADE
+) ENGINE=InnoDB`,
+			},
+		},
+		{
+			version:     5,
+			description: "add item categories and tags",
+			statements: []string{`
+ALTER TABLE items ADD COLUMN category VARCHAR(32) NOT NULL DEFAULT 'other'`, `
+CREATE TABLE item_tags (
+	item_id INTEGER NOT NULL,
+	tag     VARCHAR(64) NOT NULL,
+	PRIMARY KEY (item_id, tag),
+	FOREIGN KEY (item_id) REFERENCES items(id) ON DELETE CASCADE
+) ENGINE=InnoDB`,
+			},
+		},
+		{
+			version:     6,
+			description: "add currencies and exchange rates",
+			statements: []string{`
+ALTER TABLE items ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'USD'`, `
+ALTER TABLE users ADD COLUMN base_currency CHAR(3) NOT NULL DEFAULT 'USD'`, `
+ALTER TABLE snapshots ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'USD'`, `
+CREATE TABLE exchange_rates (
+	currency  CHAR(3) NOT NULL,
+	base      CHAR(3) NOT NULL,
+	rate      DOUBLE NOT NULL,
+	effective BIGINT NOT NULL,
+	PRIMARY KEY (currency, base, effective)
+) ENGINE=InnoDB`,
+			},
+		},
+		{
+			version:     7,
+			description: "add item versions",
+			statements: []string{`
+ALTER TABLE items ADD COLUMN version INT NOT NULL DEFAULT 1`, `
+ALTER TABLE items ADD COLUMN updated_at BIGINT NOT NULL DEFAULT 0`, `
+UPDATE items SET updated_at = COALESCE((SELECT MAX(recorded) FROM item_values WHERE item_values.item_id = items.id), 0)`,
+			},
+		},
+		{
+			version:     8,
+			description: "add foreign keys from items to users",
+			statements: []string{`
+DELETE FROM items WHERE uid NOT IN (SELECT uid FROM users)`, `
+ALTER TABLE items ADD CONSTRAINT items_user FOREIGN KEY (uid) REFERENCES users(uid) ON DELETE CASCADE`,
+			},
+		},
+		{
+			version:     9,
+			description: "add profile settings",
+			statements: []string{`
+ALTER TABLE users ADD COLUMN display_name VARCHAR(64) NOT NULL DEFAULT ''`, `
+ALTER TABLE users ADD COLUMN locale VARCHAR(35) NOT NULL DEFAULT 'en-US'`, `
+ALTER TABLE users ADD COLUMN fiscal_year_start INT NOT NULL DEFAULT 1`,
+			},
+		},
+		{
+			// migration 4 only made the table, so items from before it have no history yet
+			version:     10,
+			description: "record starting values for items without history",
+			statements: []string{`
+INSERT INTO item_values (item_id, value, recorded)
+SELECT id, value, UNIX_TIMESTAMP() FROM items
+WHERE NOT EXISTS (SELECT 1 FROM item_values WHERE item_values.item_id = items.id)`,
+			},
+		},
+		{
+			// the default collations ignore case, so Alice and alice would collide here but not
+			// on sqlite, binary collations make names and tags compare exactly on both
+			version:     11,
+			description: "compare user names and tags case sensitively",
+			statements: []string{`
+ALTER TABLE users MODIFY name VARCHAR(64) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin`, `
+ALTER TABLE item_tags MODIFY tag VARCHAR(64) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL`,
+			},
+		},
+		{
+			// the tables were made in the server's default character set, whose collation ignores
+			// case, so item names sorted and filtered differently than on sqlite and couldn't hold
+			// every character, converting them makes each text column utf8mb4 compared exactly
+			version:     12,
+			description: "store all text as utf8mb4 and compare it exactly",
+			statements: []string{`
+ALTER TABLE users CONVERT TO CHARACTER SET utf8mb4 COLLATE utf8mb4_bin`, `
+ALTER TABLE items CONVERT TO CHARACTER SET utf8mb4 COLLATE utf8mb4_bin`, `
+ALTER TABLE item_tags CONVERT TO CHARACTER SET utf8mb4 COLLATE utf8mb4_bin`, `
+ALTER TABLE sessions CONVERT TO CHARACTER SET utf8mb4 COLLATE utf8mb4_bin`, `
+ALTER TABLE snapshots CONVERT TO CHARACTER SET utf8mb4 COLLATE utf8mb4_bin`, `
+ALTER TABLE snapshot_items CONVERT TO CHARACTER SET utf8mb4 COLLATE utf8mb4_bin`, `
+ALTER TABLE exchange_rates CONVERT TO CHARACTER SET utf8mb4 COLLATE utf8mb4_bin`,
+			},
+		},
+		{
+			// the periodic snapshots look up each user's latest one
+			version:     13,
+			description: "index snapshots by user and time",
+			statements: []string{`
+CREATE INDEX snapshots_uid_taken ON snapshots (uid, taken)`,
+			},
+		},
+	},
+}
+
+func mysqlUniqueViolation(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry
+}
@@ -2,20 +2,38 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 func main() {
-	fmt.Println("Starting WorthTracker server on port 3000...")
-
-	// load database endpoint
-	dataEndpoint := loadDatabaseEndpoint()
+	// load the settings, any arguments after the flags name a command
+	config, args, err := LoadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		fmt.Println(commandUsage)
+		return
+	} else if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(2)
+	}
+	configureLogging(config)
+	allowOrigins(config.CORSOrigins)
 
 	// open database access
-	dataAccess, err := OpenDataAccess(dataEndpoint)
+	dataAccess, err := OpenDataAccess(config.Driver, config.DSN)
 	// if we failed to open the database, abort
 	if err != nil {
 		log.Panic(err)
@@ -24,7 +42,23 @@ func main() {
 	// the server shuts down
 	defer dataAccess.Close()
 
-	// ensure database is setup
+	// command line modes work on the database and then exit
+	if len(args) > 0 {
+		if err := runCommand(dataAccess, args, os.Stdin); err != nil {
+			fmt.Println(err.Error())
+			dataAccess.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
+	logInfo(context.Background(), "Starting WorthTracker server", field("listen", config.Listen))
+
+	// everything the server does from here on is measured, see /metrics
+	metrics := NewServerMetrics()
+	dataAccess = InstrumentDataAccess(dataAccess, metrics)
+
+	// ensure database is setup and all migrations are applied
 	err = dataAccess.Standup(context.Background())
 	// if we failed to standup the database, abort
 	if err != nil {
@@ -32,28 +66,230 @@ func main() {
 	}
 
 	// setup http handlers
-	userHandlers := userHandlers{da: dataAccess}
-	http.HandleFunc("/api/user", userHandlers.UserRequestHandler)
+	registerHandlers(http.DefaultServeMux, dataAccess, metrics)
+
+	if config.StaticDir != "" {
+		if _, err := os.Stat(config.StaticDir); os.IsNotExist(err) {
+			logWarn(context.Background(), "The static directory does not exist, has the client been built?", field("dir", config.StaticDir))
+		}
+		fs := http.FileServer(http.Dir(config.StaticDir))
+		http.Handle("/", fs)
+	}
+
+	// begin running the server, this returns once it has been shut down
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		logError(context.Background(), "Failed to listen", field("listen", config.Listen), field("error", err.Error()))
+		dataAccess.Close()
+		os.Exit(1)
+	}
+	handler := metrics.Instrument(http.DefaultServeMux, withRequestLog(withRequestTimeout(http.DefaultServeMux, config.requestTimeout)))
+	if err := serve(config, listener, handler, dataAccess); err != nil {
+		logError(context.Background(), "Server stopped", field("error", err.Error()))
+		dataAccess.Close()
+		os.Exit(1)
+	}
+	logInfo(context.Background(), "WorthTracker server stopped")
+}
+
+// Registers every api handler on a mux
+func registerHandlers(mux *http.ServeMux, da DataAccess, metrics *ServerMetrics) {
+	// probes come from the orchestrator rather than a user, so they need no session
+	healthHandlers := healthHandlers{da: da}
+	mux.HandleFunc("/healthz", healthHandlers.HealthRequestHandler)
+	mux.HandleFunc("/readyz", healthHandlers.ReadyRequestHandler)
+	mux.HandleFunc("/version", healthHandlers.VersionRequestHandler)
 
-	itemHandlers := itemHandlers{da: dataAccess}
-	http.HandleFunc("/api/item", itemHandlers.ItemRequestHandler)
-	http.HandleFunc("/api/itemlist", itemHandlers.ItemListRequestHandler)
-	http.HandleFunc("/api/itemdelete", itemHandlers.ItemDeleteRequestHandler)
+	metricsHandlers := metricsHandlers{da: da, metrics: metrics}
+	mux.HandleFunc("/metrics", metricsHandlers.MetricsRequestHandler)
 
-	fs := http.FileServer(http.Dir("./../client/dist"))
-	http.Handle("/", fs)
+	userHandlers := userHandlers{da: da}
+	mux.HandleFunc("/api/user", userHandlers.UserRequestHandler)
 
-	// begin running the server
-	log.Panic(http.ListenAndServe(":3000", nil))
+	sessionHandlers := sessionHandlers{da: da}
+	mux.HandleFunc("/api/login", sessionHandlers.LoginRequestHandler)
+	mux.HandleFunc("/api/logout", sessionHandlers.LogoutRequestHandler)
+	mux.HandleFunc("/api/profile", sessionHandlers.RequireUser(userHandlers.ProfileRequestHandler))
+
+	// item handlers always act on behalf of the logged in user
+	itemHandlers := itemHandlers{da: da}
+	mux.HandleFunc("/api/item", sessionHandlers.RequireUser(itemHandlers.ItemRequestHandler))
+	mux.HandleFunc("/api/itemlist", sessionHandlers.RequireUser(itemHandlers.ItemListRequestHandler))
+	mux.HandleFunc("/api/itemdelete", sessionHandlers.RequireUser(itemHandlers.ItemDeleteRequestHandler))
+	mux.HandleFunc("/api/itemhistory", sessionHandlers.RequireUser(itemHandlers.ItemHistoryRequestHandler))
+
+	batchHandlers := batchHandlers{da: da}
+	mux.HandleFunc("/api/itembatch", sessionHandlers.RequireUser(batchHandlers.ItemBatchRequestHandler))
+
+	importHandlers := importHandlers{da: da}
+	mux.HandleFunc("/api/itemimport", sessionHandlers.RequireUser(importHandlers.ItemImportRequestHandler))
+
+	exportHandlers := exportHandlers{da: da}
+	mux.HandleFunc("/api/export", sessionHandlers.RequireUser(exportHandlers.ExportRequestHandler))
+
+	snapshotHandlers := snapshotHandlers{da: da}
+	mux.HandleFunc("/api/snapshot", sessionHandlers.RequireUser(snapshotHandlers.SnapshotRequestHandler))
+	mux.HandleFunc("/api/snapshots", sessionHandlers.RequireUser(snapshotHandlers.SnapshotHistoryRequestHandler))
+
+	// the v2 api routes on resource paths, so one handler takes the whole tree
+	v2Handlers := v2Handlers{da: da}
+	mux.HandleFunc("/api/v2/", sessionHandlers.RequireUser(v2Handlers.RequestHandler))
+
+	currencyHandlers := currencyHandlers{da: da}
+	mux.HandleFunc("/api/exchangerates", sessionHandlers.RequireUser(currencyHandlers.ExchangeRateRequestHandler))
 }
 
-func loadDatabaseEndpoint() string {
-	// try to load the database endpoint from a file
-	buffer, err := ioutil.ReadFile("database.txt")
-	if err != nil {
-		fmt.Println("Could not load database endpoint from database.txt")
-		log.Panic(err)
+// Serves the handler on the listener until SIGINT or SIGTERM, then stops taking new connections
+// and gives the requests in flight up to the shutdown timeout to finish
+// Requests still running after that have their contexts cancelled and are cut off
+func serve(config *Config, listener net.Listener, handler http.Handler, da DataAccess) error {
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	requests, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	server := &http.Server{
+		Handler:     handler,
+		BaseContext: func(net.Listener) context.Context { return requests },
+	}
+
+	// record everyone's net worth in the background, a snapshot which has
+	// started is finished before we return and the database is closed
+	snapshots, stopSnapshots := context.WithCancel(signals)
+	var background sync.WaitGroup
+	defer background.Wait()
+	defer stopSnapshots()
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		runPeriodicSnapshots(snapshots, da, snapshotInterval, snapshotCheckInterval)
+	}()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-served:
+		// the server stopped without being asked to, such as when the listener failed
+		return err
+	case <-signals.Done():
+	}
+
+	// a second signal now stops the process at once
+	stopSignals()
+	logInfo(context.Background(), "Shutting down, waiting for requests to finish", field("timeout", config.shutdownTimeout.String()))
+
+	drain, cancelDrain := context.WithTimeout(context.Background(), config.shutdownTimeout)
+	defer cancelDrain()
+	if err := server.Shutdown(drain); err != nil {
+		logWarn(context.Background(), "Requests did not finish in time, cancelling them", field("error", err.Error()))
+		cancelRequests()
+		server.Close()
 	}
+	return nil
+}
+
+// Wraps a handler so every request has a deadline, once it passes the database work
+// the request started is cancelled and the handler responds with a timeout
+func withRequestTimeout(next http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		limited, cancel := context.WithTimeout(request.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(writer, request.WithContext(limited))
+	})
+}
+
+const requestIDHeader = "X-Request-ID"
+
+// Ids given by a proxy in front of us are kept so its logs and ours line up, as long as they look like ids
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// Probes and scrapes arrive every few seconds, so they are only logged at debug
+var quietRoutes = map[string]bool{"/healthz": true, "/readyz": true, "/version": true, "/metrics": true}
+
+// Wraps a handler so every request has an id, which tags each line it logs and is echoed
+// back in the X-Request-ID header, and is logged once it has been handled
+func withRequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		writer.Header().Set(requestIDHeader, id)
+		request = request.WithContext(context.WithValue(request.Context(), requestLogKey{}, &requestLog{id: id}))
+
+		recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(recorder, request)
+
+		logAccess := logInfo
+		if quietRoutes[request.URL.Path] {
+			logAccess = logDebug
+		}
+		logAccess(request.Context(), "Handled request", field("method", request.Method),
+			field("path", requestLogPath(request)), field("status", recorder.status),
+			field("duration_ms", float64(time.Since(start).Microseconds())/1000))
+	})
+}
 
-	return string(buffer)
+// Generates an id for a request which didn't come with one
+func newRequestID() string {
+	buffer := make([]byte, 12)
+	if _, err := rand.Read(buffer); err != nil {
+		// ids only need to tell requests apart, so the time will do
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(buffer)
+}
+
+// Helper method to give the path a request is logged under, without its query
+// With redaction on the user name in v2 user paths is left out
+func requestLogPath(request *http.Request) string {
+	path := request.URL.EscapedPath()
+	if !logSettings.redact || !strings.HasPrefix(path, v2Prefix+"users/") {
+		return path
+	}
+	segments := strings.SplitN(strings.TrimPrefix(path, v2Prefix+"users/"), "/", 2)
+	segments[0] = redactedValue
+	return v2Prefix + "users/" + strings.Join(segments, "/")
+}
+
+// The origins whose pages may call the api with the user's session, set from the config at startup
+// A built client is served from our own origin and needs none, see defaultConfig for the dev server
+var allowedOrigins = map[string]bool{}
+
+// Replaces the origins the api accepts, a * entry lets any origin call it without the session
+func allowOrigins(origins []string) {
+	allowedOrigins = make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		allowedOrigins[origin] = true
+	}
+}
+
+// Sets the content type and CORS headers shared by all of the API handlers
+func writeAPIHeaders(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	origin := request.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+	// the response depends on who asked, so caches mustn't hand it to another origin
+	writer.Header().Add("Vary", "Origin")
+
+	// browsers will only send the session cookie cross-origin to an origin we name, so only
+	// the origins which were listed get credentials, * is answered as a plain wildcard
+	// origins which aren't allowed get no CORS headers, so browsers keep the response from them
+	if allowedOrigins[origin] {
+		writer.Header().Set("Access-Control-Allow-Origin", origin)
+		writer.Header().Set("Access-Control-Allow-Credentials", "true")
+	} else if allowedOrigins["*"] {
+		writer.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		return
+	}
+	writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, PATCH, DELETE")
+	writer.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, If-Match, X-Request-ID")
+	writer.Header().Set("Access-Control-Expose-Headers", "ETag, Location, X-Request-ID")
 }
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// handlers log every failure, which is only noise here
+	logOutput = ioutil.Discard
+	os.Exit(m.Run())
+}
+
+// A running copy of the api with its own database
+type testAPI struct {
+	da     DataAccess
+	server *httptest.Server
+}
+
+// A client of the test api, holding one user's session
+type testClient struct {
+	t      *testing.T
+	api    *testAPI
+	client *http.Client
+}
+
+// Helper method to start the api on an empty sqlite database, served like main serves it
+func newTestAPI(t *testing.T) *testAPI {
+	t.Helper()
+	// writers queue for the database rather than failing when requests overlap
+	dsn := filepath.Join(t.TempDir(), "test.db") + "?_busy_timeout=5000"
+	da := openTestDataAccess(t, sqliteDialect.driver, dsn, false)
+
+	mux := http.NewServeMux()
+	metrics := NewServerMetrics()
+	registerHandlers(mux, InstrumentDataAccess(da, metrics), metrics)
+	server := httptest.NewServer(metrics.Instrument(mux, withRequestLog(withRequestTimeout(mux, 30*time.Second))))
+	t.Cleanup(server.Close)
+
+	return &testAPI{da: da, server: server}
+}
+
+// Helper method to get a client with no session
+func (api *testAPI) anonymous(t *testing.T) *testClient {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t: t, api: api, client: &http.Client{Jar: jar}}
+}
+
+// Helper method to sign up a user and get a client logged in as them
+func (api *testAPI) login(t *testing.T, name string) *testClient {
+	t.Helper()
+	client := api.anonymous(t)
+	credentials := map[string]string{"Name": name, "Password": "password123"}
+	client.expect(http.MethodPost, "/api/user", credentials, http.StatusOK)
+	client.expect(http.MethodPost, "/api/login", credentials, http.StatusOK)
+	return client
+}
+
+// Sends a request, a body which isn't already a string is sent as JSON
+// Headers are given in pairs of name and value
+func (client *testClient) do(method string, path string, body interface{}, headers ...string) (*http.Response, []byte) {
+	client.t.Helper()
+	var reader io.Reader
+	switch body := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(body)
+	default:
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			client.t.Fatal(err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	request, err := http.NewRequest(method, client.api.server.URL+path, reader)
+	if err != nil {
+		client.t.Fatal(err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		request.Header.Set(headers[i], headers[i+1])
+	}
+
+	response, err := client.client.Do(request)
+	if err != nil {
+		client.t.Fatal(err)
+	}
+	defer response.Body.Close()
+	content, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		client.t.Fatal(err)
+	}
+	return response, content
+}
+
+// Sends a request and fails the test unless it gets the status, giving the body
+func (client *testClient) expect(method string, path string, body interface{}, status int, headers ...string) []byte {
+	client.t.Helper()
+	response, content := client.do(method, path, body, headers...)
+	if response.StatusCode != status {
+		client.t.Fatalf("%s %s gave %d, want %d: %s", method, path, response.StatusCode, status, content)
+	}
+	return content
+}
+
+// Helper method to decode a response body, failing the test if it can't be
+func decodeTestBody(t *testing.T, content []byte, into interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(content, into); err != nil {
+		t.Fatalf("decoding %s: %v", content, err)
+	}
+}
+
+// Helper method to check an error response carries the expected code
+func expectErrorCode(t *testing.T, content []byte, code string) {
+	t.Helper()
+	var response ErrorResponse
+	decodeTestBody(t, content, &response)
+	if response.Code != code {
+		t.Errorf("error code %q, want %q: %s", response.Code, code, content)
+	}
+}
+
+func TestRequestIDIsEchoed(t *testing.T) {
+	client := newTestAPI(t).anonymous(t)
+
+	response, _ := client.do(http.MethodGet, "/healthz", nil, requestIDHeader, "proxy-abc.123")
+	if id := response.Header.Get(requestIDHeader); id != "proxy-abc.123" {
+		t.Errorf("echoed %q, want the proxy's id", id)
+	}
+
+	// ids which don't look like ids are replaced rather than repeated back
+	response, _ = client.do(http.MethodGet, "/healthz", nil, requestIDHeader, "bad id\"")
+	if id := response.Header.Get(requestIDHeader); id == "" || id == "bad id\"" {
+		t.Errorf("echoed %q, want a new id", id)
+	}
+}
+
+func TestCORSOrigins(t *testing.T) {
+	client := newTestAPI(t).anonymous(t)
+	defer allowOrigins(nil)
+
+	// none are allowed when none are listed
+	allowOrigins(nil)
+	response, _ := client.do(http.MethodGet, "/api/user", nil, "Origin", "https://evil.example")
+	if origin := response.Header.Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Errorf("allowed %q with no origins configured", origin)
+	}
+
+	// a wildcard never comes with the session
+	allowOrigins([]string{"*"})
+	response, _ = client.do(http.MethodGet, "/api/user", nil, "Origin", "https://evil.example")
+	if origin := response.Header.Get("Access-Control-Allow-Origin"); origin != "*" {
+		t.Errorf("allowed %q, want *", origin)
+	}
+	if response.Header.Get("Access-Control-Allow-Credentials") != "" {
+		t.Error("credentials allowed for a wildcard origin")
+	}
+
+	// the client's dev server can call the api with the session out of the box
+	config := defaultConfig()
+	allowOrigins(config.CORSOrigins)
+	response, _ = client.do(http.MethodGet, "/api/user", nil, "Origin", clientDevOrigin)
+	if response.Header.Get("Access-Control-Allow-Origin") != clientDevOrigin ||
+		response.Header.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("the client's dev server was not allowed by default")
+	}
+
+	// other listed origins come with it too
+	allowOrigins([]string{"https://app.example"})
+	response, _ = client.do(http.MethodGet, "/api/user", nil, "Origin", "https://app.example")
+	if origin := response.Header.Get("Access-Control-Allow-Origin"); origin != "https://app.example" {
+		t.Errorf("allowed %q, want the listed origin", origin)
+	}
+	if response.Header.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Error("credentials not allowed for a listed origin")
+	}
+}
+
+// Helper method to run serve on a local port, giving the address and what serve returns
+func startTestServe(t *testing.T, handler http.Handler, shutdownTimeout time.Duration) (string, chan error) {
+	t.Helper()
+	config := defaultConfig()
+	config.shutdownTimeout = shutdownTimeout
+	da := openTestDataAccess(t, sqliteDialect.driver, filepath.Join(t.TempDir(), "test.db"), false)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- serve(&config, listener, handler, da)
+	}()
+	return "http://" + listener.Addr().String(), stopped
+}
+
+// Helper method to stop serve the way an orchestrator would
+func interruptTestServe(t *testing.T) {
+	t.Helper()
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Signal(os.Interrupt); err != nil {
+		t.Skip("signals can't be sent here: " + err.Error())
+	}
+}
+
+func TestServeFinishesRequestsInFlight(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(writer, "done")
+	})
+	address, stopped := startTestServe(t, handler, 10*time.Second)
+
+	responses := make(chan string, 1)
+	go func() {
+		response, err := http.Get(address)
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		defer response.Body.Close()
+		content, _ := ioutil.ReadAll(response.Body)
+		responses <- string(content)
+	}()
+	<-started
+	interruptTestServe(t)
+
+	// the request still running holds up the shutdown
+	select {
+	case err := <-stopped:
+		t.Fatalf("serve returned %v with a request in flight", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// and no new ones are taken in the meantime
+	if response, err := http.Get(address); err == nil {
+		response.Body.Close()
+		t.Error("a new request was served while shutting down")
+	}
+
+	close(release)
+	if content := <-responses; content != "done" {
+		t.Errorf("request in flight got %q, want it finished", content)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("serve returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return once the request finished")
+	}
+}
+
+func TestServeCancelsRequestsAfterTheShutdownTimeout(t *testing.T) {
+	started, cancelled := make(chan struct{}), make(chan struct{})
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		close(started)
+		<-request.Context().Done()
+		close(cancelled)
+	})
+	address, stopped := startTestServe(t, handler, 100*time.Millisecond)
+
+	go func() {
+		if response, err := http.Get(address); err == nil {
+			response.Body.Close()
+		}
+	}()
+	<-started
+	interruptTestServe(t)
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request was not cancelled after the shutdown timeout")
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("serve returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after the shutdown timeout")
+	}
+}
+
+func TestProbesAreOnlyLoggedAtDebug(t *testing.T) {
+	client := newTestAPI(t).anonymous(t)
+	var output bytes.Buffer
+	logOutput = &output
+	defer func() { logOutput = ioutil.Discard }()
+
+	for _, path := range []string{"/healthz", "/readyz", "/version", "/metrics"} {
+		client.expect(http.MethodGet, path, nil, http.StatusOK)
+	}
+	if output.Len() != 0 {
+		t.Errorf("probes were logged at info: %s", output.String())
+	}
+
+	client.expect(http.MethodGet, "/api/user", nil, http.StatusOK)
+	if !strings.Contains(output.String(), "path=/api/user") {
+		t.Errorf("other requests were not logged: %s", output.String())
+	}
+}
+
+func TestRequestTimeoutStopsSlowRequests(t *testing.T) {
+	da := openTestDataAccess(t, sqliteDialect.driver, filepath.Join(t.TempDir(), "test.db"), false)
+	handler := withRequestTimeout(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		// outlast the deadline, then try to reach the database as a slow handler would
+		<-request.Context().Done()
+		if _, err := da.GetUsers(request.Context()); err != nil {
+			writeError(writer, request, err)
+			return
+		}
+		io.WriteString(writer, "done")
+	}), 50*time.Millisecond)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/user", nil))
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status %d, want 504: %s", recorder.Code, recorder.Body.String())
+	}
+	expectErrorCode(t, recorder.Body.Bytes(), "timeout")
+}
+
+func TestRequestTimeoutLeavesQuickRequestsAlone(t *testing.T) {
+	handler := withRequestTimeout(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		deadline, ok := request.Context().Deadline()
+		if !ok || time.Until(deadline) > time.Minute {
+			t.Errorf("the request had no deadline within the timeout")
+		}
+		io.WriteString(writer, "done")
+	}), time.Minute)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/user", nil))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "done" {
+		t.Errorf("got %d %q, want the handler's response", recorder.Code, recorder.Body.String())
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+const (
+	insertSessionCommand = `
+INSERT INTO sessions (token_hash, uid, expires) VALUES ($1, $2, $3)
+`
+	findSessionCommand = `
+SELECT token_hash, uid, expires FROM sessions WHERE token_hash = $1
+`
+	deleteSessionCommand = `
+DELETE FROM sessions WHERE token_hash = $1
+`
+	deleteUserSessionsCommand = `
+DELETE FROM sessions WHERE uid = $1
+`
+	deleteExpiredSessionsCommand = `
+DELETE FROM sessions WHERE expires < $1
+`
+)
+
+// Sessions are keyed by a hash of the token we hand to the client,
+// so a leaked database does not leak usable session cookies
+type SessionEntry struct {
+	TokenHash string
+	Uid       int
+	// unix time in seconds
+	Expires int64
+}
+
+func (da DataAccessSQL) AddSession(context context.Context, tokenHash string, userid int, expires int64) error {
+	_, err := da.runner().ExecContext(context, da.bind(insertSessionCommand), tokenHash, userid, expires)
+	return err
+}
+
+func (da DataAccessSQL) FindSession(context context.Context, tokenHash string) (*SessionEntry, error) {
+	rows, err := da.runner().QueryContext(context, da.bind(findSessionCommand), tokenHash)
+	// make sure to clean up rows when we're finished
+	defer func() {
+		if rows != nil {
+			rows.Close()
+		}
+	}()
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// process the rows into SessionEntries
+	for rows.Next() {
+		// check for errors
+		err = rows.Err()
+		if err != nil {
+			return nil, err
+		}
+
+		// scan the next row
+		var hash string
+		var uid int
+		var expires int64
+		err = rows.Scan(&hash, &uid, &expires)
+		if err != nil {
+			return nil, err
+		}
+
+		return &SessionEntry{TokenHash: hash, Uid: uid, Expires: expires}, nil
+	}
+
+	return nil, nil
+}
+
+func (da DataAccessSQL) DeleteSession(context context.Context, tokenHash string) error {
+	_, err := da.runner().ExecContext(context, da.bind(deleteSessionCommand), tokenHash)
+	return err
+}
+
+func (da DataAccessSQL) DeleteExpiredSessions(context context.Context, now int64) error {
+	_, err := da.runner().ExecContext(context, da.bind(deleteExpiredSessionsCommand), now)
+	return err
+}
+
+func (da DataAccessSQL) DeleteUserSessions(context context.Context, userid int) error {
+	_, err := da.runner().ExecContext(context, da.bind(deleteUserSessionsCommand), userid)
+	return err
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sessionCookieName = "worthtracker_session"
+	sessionDuration   = 7 * 24 * time.Hour
+	minPasswordLength = 8
+	// bcrypt silently ignores anything past 72 bytes
+	maxPasswordLength = 72
+)
+
+type sessionHandlers struct {
+	da DataAccess
+}
+
+type loginRequest struct {
+	Name     string
+	Password string
+}
+
+type InvalidPasswordError struct {
+	Reason string
+}
+
+func (err *InvalidPasswordError) Error() string {
+	return "Invalid password: " + err.Reason
+}
+
+type InvalidCredentialsError struct{}
+
+func (err *InvalidCredentialsError) Error() string {
+	return "Invalid username or password."
+}
+
+// Accounts made before passwords were added have none until one is set from the command line
+type PasswordNotSetError struct{}
+
+func (err *PasswordNotSetError) Error() string {
+	return "This account has no password yet, ask the server's administrator to set one with 'worthtracker password'."
+}
+
+type NotAuthenticatedError struct{}
+
+func (err *NotAuthenticatedError) Error() string {
+	return "You must be logged in to do that."
+}
+
+// Helper method to validate a new password
+func validatePassword(password string) error {
+	// bcrypt works on bytes, so measure bytes rather than runes here
+	if len(password) < minPasswordLength {
+		return &InvalidPasswordError{Reason: fmt.Sprintf("Must be at least %d characters.", minPasswordLength)}
+	} else if len(password) > maxPasswordLength {
+		return &InvalidPasswordError{Reason: fmt.Sprintf("Must be at most %d bytes.", maxPasswordLength)}
+	}
+	return nil
+}
+
+// Salts and hashes a password for storage
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// Generates a new random session token to hand to the client
+func newSessionToken() (string, error) {
+	buffer := make([]byte, 32)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buffer), nil
+}
+
+// Hashes a session token for storage, only the client ever holds the real token
+func hashSessionToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Helper method to check a password against the user's stored hash
+func checkPassword(user *UserEntry, password string) error {
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return &InvalidCredentialsError{}
+	}
+	return nil
+}
+
+// Verifies a user's password and starts a new session for them
+// Returns the session token and the time at which it expires
+func Login(context context.Context, da DataAccess, name string, password string) (*UserEntry, string, time.Time, error) {
+	// find the user, but don't reveal whether it was the name or the password that was wrong
+	user, err := da.FindUserByName(context, name)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	} else if user == nil {
+		return nil, "", time.Time{}, &InvalidCredentialsError{}
+	} else if user.PasswordHash == "" {
+		return nil, "", time.Time{}, &PasswordNotSetError{}
+	}
+
+	// check the password against the stored hash
+	if err := checkPassword(user, password); err != nil {
+		return nil, "", time.Time{}, err
+	}
+
+	// clean up any stale sessions while we're here
+	now := time.Now()
+	if err := da.DeleteExpiredSessions(context, now.Unix()); err != nil {
+		return nil, "", time.Time{}, err
+	}
+
+	// start the new session
+	token, err := newSessionToken()
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	expires := now.Add(sessionDuration)
+	err = da.AddSession(context, hashSessionToken(token), user.Id, expires.Unix())
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+
+	return user, token, expires, nil
+}
+
+// Ends the session associated with a token
+func Logout(context context.Context, da DataAccess, token string) error {
+	return da.DeleteSession(context, hashSessionToken(token))
+}
+
+// Sets a new password for the user and ends every session they have
+// This is how accounts from before passwords were added get their first one
+func SetPassword(context context.Context, da DataAccess, user *UserEntry, password string) error {
+	if err := validatePassword(password); err != nil {
+		return err
+	}
+	passwordHash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return da.WithTransaction(context, func(tx DataAccess) error {
+		if err := tx.SetPasswordHash(context, user.Id, passwordHash); err != nil {
+			return err
+		}
+		return tx.DeleteUserSessions(context, user.Id)
+	})
+}
+
+// Finds the user who owns a session token
+func AuthenticateSession(context context.Context, da DataAccess, token string) (*UserEntry, error) {
+	session, err := da.FindSession(context, hashSessionToken(token))
+	if err != nil {
+		return nil, err
+	} else if session == nil || session.Expires <= time.Now().Unix() {
+		return nil, &NotAuthenticatedError{}
+	}
+
+	user, err := da.FindUserById(context, session.Uid)
+	if err != nil {
+		return nil, err
+	} else if user == nil {
+		return nil, &NotAuthenticatedError{}
+	}
+	return user, nil
+}
+
+type userContextKey struct{}
+
+// Wraps a handler so that it can only be reached with a valid session cookie
+// The authenticated user is attached to the request, see requestUser
+func (sh sessionHandlers) RequireUser(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		// preflight requests never carry cookies
+		if request.Method == http.MethodOptions {
+			next(writer, request)
+			return
+		}
+
+		var user *UserEntry
+		cookie, err := request.Cookie(sessionCookieName)
+		if err != nil {
+			err = &NotAuthenticatedError{}
+		} else {
+			user, err = AuthenticateSession(request.Context(), sh.da, cookie.Value)
+		}
+
+		if err != nil {
+			writeAPIHeaders(writer, request)
+			writeError(writer, request, err)
+			return
+		}
+
+		// the rest of the request's log lines say who it was for
+		if entry := requestLogFrom(request.Context()); entry != nil {
+			entry.user = user.Name
+		}
+		next(writer, request.WithContext(context.WithValue(request.Context(), userContextKey{}, user)))
+	}
+}
+
+// Gets the authenticated user for a request wrapped by RequireUser
+func requestUser(request *http.Request) *UserEntry {
+	user, _ := request.Context().Value(userContextKey{}).(*UserEntry)
+	return user
+}
+
+// Handles the incoming http requests for logging in
+func (sh sessionHandlers) LoginRequestHandler(writer http.ResponseWriter, request *http.Request) {
+	writeAPIHeaders(writer, request)
+
+	switch request.Method {
+	case http.MethodOptions:
+		return
+	case http.MethodPost:
+		var login loginRequest
+		err := json.NewDecoder(request.Body).Decode(&login)
+		if err != nil {
+			logWarn(request.Context(), "Failed to decode login request", errorField(err))
+			writeError(writer, request, &InvalidRequestError{Reason: err.Error()})
+			return
+		}
+
+		user, token, expires, err := Login(request.Context(), sh.da, login.Name, login.Password)
+		if err != nil {
+			logWarn(request.Context(), "Failed to log in", errorField(err))
+			writeError(writer, request, err)
+			return
+		}
+
+		http.SetCookie(writer, &http.Cookie{
+			Name:     sessionCookieName,
+			Value:    token,
+			Path:     "/",
+			Expires:  expires,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+
+		// respond with the logged in user
+		json.NewEncoder(writer).Encode(user)
+	default:
+		writeError(writer, request, &MethodNotAllowedError{Method: request.Method})
+	}
+}
+
+// Helper method to tell the browser to forget the session cookie
+func clearSessionCookie(writer http.ResponseWriter) {
+	http.SetCookie(writer, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// Handles the incoming http requests for logging out
+func (sh sessionHandlers) LogoutRequestHandler(writer http.ResponseWriter, request *http.Request) {
+	writeAPIHeaders(writer, request)
+
+	switch request.Method {
+	case http.MethodOptions:
+		return
+	case http.MethodPost:
+		// logging out without a session is a no-op
+		if cookie, err := request.Cookie(sessionCookieName); err == nil {
+			if err := Logout(request.Context(), sh.da, cookie.Value); err != nil {
+				logWarn(request.Context(), "Failed to log out", errorField(err))
+				writeError(writer, request, err)
+				return
+			}
+		}
+
+		clearSessionCookie(writer)
+	default:
+		writeError(writer, request, &MethodNotAllowedError{Method: request.Method})
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// Helper method to get the session token the client's cookie jar holds
+func testSessionToken(client *testClient) string {
+	client.t.Helper()
+	address, err := url.Parse(client.api.server.URL)
+	if err != nil {
+		client.t.Fatal(err)
+	}
+	for _, cookie := range client.client.Jar.Cookies(address) {
+		if cookie.Name == sessionCookieName {
+			return cookie.Value
+		}
+	}
+	client.t.Fatal("the client has no session cookie")
+	return ""
+}
+
+// Helper method to find the session cookie a response sets
+func findSessionCookie(response *http.Response) *http.Cookie {
+	for _, cookie := range response.Cookies() {
+		if cookie.Name == sessionCookieName {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestAnonymousRequestsAreRefused(t *testing.T) {
+	api := newTestAPI(t)
+	api.login(t, "alice")
+	client := api.anonymous(t)
+
+	for _, path := range []string{"/api/item", "/api/itemlist", "/api/profile", "/api/v2/users/alice", "/api/v2/items/1"} {
+		content := client.expect(http.MethodGet, path, nil, http.StatusUnauthorized)
+		expectErrorCode(t, content, "not_authenticated")
+	}
+
+	// a token we never handed out is no better than none
+	content := client.expect(http.MethodGet, "/api/profile", nil, http.StatusUnauthorized,
+		"Cookie", sessionCookieName+"=made-up")
+	expectErrorCode(t, content, "not_authenticated")
+}
+
+func TestLoginSetsASessionCookie(t *testing.T) {
+	api := newTestAPI(t)
+	api.login(t, "alice")
+	client := api.anonymous(t)
+
+	// a wrong password or name gets the same answer and no session
+	for _, credentials := range []map[string]string{
+		{"Name": "alice", "Password": "wrong password"},
+		{"Name": "nobody", "Password": "password123"},
+	} {
+		response, content := client.do(http.MethodPost, "/api/login", credentials)
+		if response.StatusCode != http.StatusUnauthorized || findSessionCookie(response) != nil {
+			t.Fatalf("logging in as %s gave %d: %s", credentials["Name"], response.StatusCode, content)
+		}
+		expectErrorCode(t, content, "invalid_credentials")
+	}
+
+	response, content := client.do(http.MethodPost, "/api/login", map[string]string{"Name": "alice", "Password": "password123"})
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("logging in gave %d: %s", response.StatusCode, content)
+	}
+	cookie := findSessionCookie(response)
+	if cookie == nil {
+		t.Fatal("logging in set no session cookie")
+	}
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteStrictMode || cookie.Path != "/" {
+		t.Errorf("session cookie is %s, want it HttpOnly, SameSite=Strict and on /", cookie.String())
+	}
+	if until := time.Until(cookie.Expires); until < sessionDuration-time.Minute || until > sessionDuration {
+		t.Errorf("session cookie expires in %v, want %v", until, sessionDuration)
+	}
+	client.expect(http.MethodGet, "/api/profile", nil, http.StatusOK)
+}
+
+func TestLogoutEndsTheSession(t *testing.T) {
+	api := newTestAPI(t)
+	client := api.login(t, "alice")
+	token := testSessionToken(client)
+
+	response, content := client.do(http.MethodPost, "/api/logout", nil)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("logging out gave %d: %s", response.StatusCode, content)
+	}
+	if cookie := findSessionCookie(response); cookie == nil || cookie.MaxAge >= 0 {
+		t.Error("logging out did not clear the session cookie")
+	}
+	client.expect(http.MethodGet, "/api/profile", nil, http.StatusUnauthorized)
+
+	// the old token is gone from the server too, so keeping a copy of the cookie is no use
+	content = api.anonymous(t).expect(http.MethodGet, "/api/profile", nil, http.StatusUnauthorized,
+		"Cookie", sessionCookieName+"="+token)
+	expectErrorCode(t, content, "not_authenticated")
+
+	// and logging out again is harmless
+	client.expect(http.MethodPost, "/api/logout", nil, http.StatusOK)
+}
+
+func TestOnlySessionTokenHashesAreStored(t *testing.T) {
+	api := newTestAPI(t)
+	token := testSessionToken(api.login(t, "alice"))
+
+	rows, err := api.da.(DataAccessSQL).database.Query("SELECT token_hash FROM sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	stored := make([]string, 0)
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			t.Fatal(err)
+		}
+		stored = append(stored, hash)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored) != 1 || stored[0] != hashSessionToken(token) || stored[0] == token {
+		t.Errorf("sessions table holds %v, want only the SHA-256 of the token", stored)
+	}
+}
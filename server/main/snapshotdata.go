@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"time"
+)
+
+const (
+	insertSnapshotCommand = `
+INSERT INTO snapshots (uid, taken, currency, net_worth, asset_total, liability_total) VALUES ($1, $2, $3, $4, $5, $6)
+`
+	insertSnapshotItemCommand = `
+INSERT INTO snapshot_items (snapshot_id, item_id, name, type, value) VALUES ($1, $2, $3, $4, $5)
+`
+	getSnapshotsCommand = `
+SELECT id, uid, taken, currency, net_worth, asset_total, liability_total FROM snapshots
+WHERE uid = $1 AND taken >= $2 AND taken <= $3
+ORDER BY taken, id
+`
+	getSnapshotItemsCommand = `
+SELECT si.snapshot_id, si.item_id, si.name, si.type, si.value FROM snapshot_items si
+JOIN snapshots s ON s.id = si.snapshot_id
+WHERE s.uid = $1 AND s.taken >= $2 AND s.taken <= $3
+`
+	getLatestSnapshotTimeCommand = `
+SELECT MAX(taken) FROM snapshots WHERE uid = $1 AND taken <= $2
+`
+)
+
+// A user's totals (and the items behind them) at a point in time
+type SnapshotEntry struct {
+	Id    int
+	Uid   int
+	Taken time.Time
+	// the user's base currency at the time, every value is counted in it
+	Currency       string
+	NetWorth       int64
+	AssetTotal     int64
+	LiabilityTotal int64
+	Items          []SnapshotItemEntry
+}
+
+// The value of a single item when a snapshot was taken
+// ItemId may refer to an item which has since been deleted
+type SnapshotItemEntry struct {
+	ItemId int
+	Name   string
+	Type   string
+	Value  int64
+}
+
+func (da DataAccessSQL) AddSnapshot(context context.Context, snapshot *SnapshotEntry) (int, error) {
+	// the snapshot and its items are written together or not at all
+	tx, err := da.begin(context)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(context, da.bind(insertSnapshotCommand), snapshot.Uid, snapshot.Taken.Unix(), snapshot.Currency,
+		snapshot.NetWorth, snapshot.AssetTotal, snapshot.LiabilityTotal)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range snapshot.Items {
+		item := &snapshot.Items[i]
+		_, err = tx.ExecContext(context, da.bind(insertSnapshotItemCommand), id, item.ItemId, item.Name, item.Type, item.Value)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return int(id), tx.Commit()
+}
+
+func (da DataAccessSQL) GetSnapshotsByUser(context context.Context, userid int, from time.Time, to time.Time) (*[]SnapshotEntry, error) {
+	// a zero end leaves the range open, however far ahead snapshots were taken
+	end := int64(math.MaxInt64)
+	if !to.IsZero() {
+		end = to.Unix()
+	}
+
+	rows, err := da.runner().QueryContext(context, da.bind(getSnapshotsCommand), userid, from.Unix(), end)
+	// make sure to clean up rows when we're finished
+	defer func() {
+		if rows != nil {
+			rows.Close()
+		}
+	}()
+
+	snapshots := make([]SnapshotEntry, 0)
+	if err == sql.ErrNoRows {
+		return &snapshots, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// process the rows into SnapshotEntries
+	indexes := make(map[int]int)
+	for rows.Next() {
+		// check for errors
+		err = rows.Err()
+		if err != nil {
+			return nil, err
+		}
+
+		// scan the next row
+		var id, uid int
+		var currency string
+		var taken, net, asset, liability int64
+		err = rows.Scan(&id, &uid, &taken, &currency, &net, &asset, &liability)
+		if err != nil {
+			return nil, err
+		}
+
+		indexes[id] = len(snapshots)
+		snapshots = append(snapshots, SnapshotEntry{Id: id, Uid: uid, Taken: time.Unix(taken, 0), Currency: currency,
+			NetWorth: net, AssetTotal: asset, LiabilityTotal: liability, Items: make([]SnapshotItemEntry, 0)})
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	// finish with the snapshots before asking for their items, a transaction
+	// or a pool of one connection can only run a single query at a time
+	rows.Close()
+
+	// attach the items to their snapshots
+	itemRows, err := da.runner().QueryContext(context, da.bind(getSnapshotItemsCommand), userid, from.Unix(), end)
+	defer func() {
+		if itemRows != nil {
+			itemRows.Close()
+		}
+	}()
+
+	if err == sql.ErrNoRows {
+		return &snapshots, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for itemRows.Next() {
+		// check for errors
+		err = itemRows.Err()
+		if err != nil {
+			return nil, err
+		}
+
+		// scan the next row
+		var snapshotId, itemId int
+		var name, itemType string
+		var value int64
+		err = itemRows.Scan(&snapshotId, &itemId, &name, &itemType, &value)
+		if err != nil {
+			return nil, err
+		}
+
+		if index, ok := indexes[snapshotId]; ok {
+			snapshots[index].Items = append(snapshots[index].Items,
+				SnapshotItemEntry{ItemId: itemId, Name: name, Type: itemType, Value: value})
+		}
+	}
+
+	return &snapshots, nil
+}
+
+func (da DataAccessSQL) GetLatestSnapshotTime(context context.Context, userid int, before time.Time) (time.Time, error) {
+	// there is no latest snapshot when the user has none, which leaves this null
+	var taken sql.NullInt64
+	err := da.runner().QueryRowContext(context, da.bind(getLatestSnapshotTimeCommand), userid, before.Unix()).Scan(&taken)
+	if err != nil || !taken.Valid {
+		return time.Time{}, err
+	}
+	return time.Unix(taken.Int64, 0), nil
+}
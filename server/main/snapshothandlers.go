@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	// how often every user's net worth is recorded automatically
+	snapshotInterval = 24 * time.Hour
+	// how often users are checked for being due one
+	snapshotCheckInterval = time.Hour
+	// date-only form accepted by the API alongside RFC 3339
+	dateLayout = "2006-01-02"
+)
+
+type snapshotHandlers struct {
+	da DataAccess
+}
+
+type InvalidDateError struct {
+	Value  string
+	Reason string
+}
+
+func (err *InvalidDateError) Error() string {
+	return err.Value + " is an invalid date: " + err.Reason
+}
+
+// Records the user's current totals and item values
+func TakeSnapshot(context context.Context, da DataAccess, user *UserEntry) (*SnapshotEntry, error) {
+	itemList, err := GetItems(context, da, user, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := SnapshotEntry{
+		Uid:            user.Id,
+		Taken:          time.Now().Truncate(time.Second),
+		Currency:       itemList.BaseCurrency,
+		NetWorth:       itemList.NetWorth,
+		AssetTotal:     itemList.AssetTotal,
+		LiabilityTotal: itemList.LiabilityTotal,
+		Items:          make([]SnapshotItemEntry, 0, len(*itemList.Items)),
+	}
+	// item values are recorded in the base currency, like the totals, so items
+	// which could not be converted are left out of the snapshot as they are of the totals
+	for i, item := range *itemList.Items {
+		if itemList.Conversions[i].Unconverted {
+			continue
+		}
+		snapshot.Items = append(snapshot.Items, SnapshotItemEntry{ItemId: item.Id, Name: item.Name, Type: item.Type,
+			Value: itemList.Conversions[i].Value})
+	}
+
+	snapshot.Id, err = da.AddSnapshot(context, &snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// Gets the user's snapshots taken within [from, to], oldest first
+func GetSnapshotHistory(context context.Context, da DataAccess, user *UserEntry, from time.Time, to time.Time) (*[]SnapshotEntry, error) {
+	if to.Before(from) {
+		return nil, &InvalidDateError{Value: to.Format(time.RFC3339), Reason: "Must not be before the start of the range."}
+	}
+	return da.GetSnapshotsByUser(context, user.Id, from, to)
+}
+
+// Helper method to parse a history range bound, either RFC 3339 or a bare date
+// A bare date used as the end of a range covers that whole day
+func parseHistoryTime(value string, fallback time.Time, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+	parsed, err := time.Parse(dateLayout, value)
+	if err != nil {
+		return time.Time{}, &InvalidDateError{Value: value, Reason: "Must be formatted as YYYY-MM-DD or RFC 3339."}
+	}
+	if endOfDay {
+		parsed = parsed.Add(24*time.Hour - time.Second)
+	}
+	return parsed, nil
+}
+
+// Takes a snapshot of every user who has gone an interval without one, when it starts and then
+// every check until the context is done
+// Going by each user's latest snapshot rather than a timer means a restart doesn't put them off
+func runPeriodicSnapshots(context context.Context, da DataAccess, interval time.Duration, check time.Duration) {
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+
+	for {
+		takeDueSnapshots(context, da, interval)
+
+		select {
+		case <-context.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Helper method to snapshot the users whose latest snapshot is older than the interval
+func takeDueSnapshots(context context.Context, da DataAccess, interval time.Duration) {
+	users, err := da.GetUsers(context)
+	if err != nil {
+		logError(context, "Failed to get users for periodic snapshot", errorField(err))
+		return
+	}
+
+	now := time.Now()
+	for i := range *users {
+		if context.Err() != nil {
+			return
+		}
+		user := &(*users)[i]
+
+		// snapshots dated after now, such as imported ones, don't count
+		latest, err := da.GetLatestSnapshotTime(context, user.Id, now)
+		if err != nil {
+			logError(context, "Failed to find the latest snapshot", sensitiveField("user", user.Name), errorField(err))
+			continue
+		} else if !latest.Before(now.Add(-interval)) {
+			continue
+		}
+
+		if _, err := TakeSnapshot(context, da, user); err != nil {
+			logError(context, "Failed to take periodic snapshot", sensitiveField("user", user.Name), errorField(err))
+		}
+	}
+}
+
+// Handles the incoming http requests to take a snapshot on demand
+func (sh snapshotHandlers) SnapshotRequestHandler(writer http.ResponseWriter, request *http.Request) {
+	writeAPIHeaders(writer, request)
+
+	switch request.Method {
+	case http.MethodOptions:
+		return
+	case http.MethodPost:
+		snapshot, err := TakeSnapshot(request.Context(), sh.da, requestUser(request))
+		if err != nil {
+			logWarn(request.Context(), "Failed to take snapshot", errorField(err))
+			writeError(writer, request, err)
+			return
+		}
+
+		// respond with the new snapshot
+		json.NewEncoder(writer).Encode(snapshot)
+	default:
+		writeError(writer, request, &MethodNotAllowedError{Method: request.Method})
+	}
+}
+
+// Handles the incoming http requests for a user's net worth history
+// Accepts optional "from" and "to" query parameters bounding the range
+func (sh snapshotHandlers) SnapshotHistoryRequestHandler(writer http.ResponseWriter, request *http.Request) {
+	writeAPIHeaders(writer, request)
+
+	switch request.Method {
+	case http.MethodOptions:
+		return
+	case http.MethodGet:
+		query := request.URL.Query()
+		from, err := parseHistoryTime(query.Get("from"), time.Unix(0, 0), false)
+		if err != nil {
+			writeError(writer, request, err)
+			return
+		}
+		to, err := parseHistoryTime(query.Get("to"), time.Now(), true)
+		if err != nil {
+			writeError(writer, request, err)
+			return
+		}
+
+		snapshots, err := GetSnapshotHistory(request.Context(), sh.da, requestUser(request), from, to)
+		if err != nil {
+			logWarn(request.Context(), "Failed to get snapshot history", errorField(err))
+			writeError(writer, request, err)
+			return
+		}
+
+		json.NewEncoder(writer).Encode(snapshots)
+	default:
+		writeError(writer, request, &MethodNotAllowedError{Method: request.Method})
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Helper method to record a snapshot for a user as of a given time
+func addTestSnapshot(t *testing.T, da DataAccess, user *UserEntry, taken time.Time, netWorth int64) {
+	t.Helper()
+	snapshot := SnapshotEntry{Uid: user.Id, Taken: taken, Currency: DefaultCurrency, NetWorth: netWorth, AssetTotal: netWorth,
+		Items: []SnapshotItemEntry{{ItemId: 1, Name: "House", Type: ItemTypeAsset, Value: netWorth}}}
+	if _, err := da.AddSnapshot(context.Background(), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Helper method to count a user's snapshots, wherever they fall
+func countTestSnapshots(t *testing.T, da DataAccess, user *UserEntry) int {
+	t.Helper()
+	snapshots, err := da.GetSnapshotsByUser(context.Background(), user.Id, time.Unix(0, 0), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(*snapshots)
+}
+
+func TestSnapshotRanges(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, da DataAccess) {
+		alice, bob := addTestUser(t, da, "alice"), addTestUser(t, da, "bob")
+		start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		for day := 0; day < 4; day++ {
+			addTestSnapshot(t, da, alice, start.AddDate(0, 0, day), int64(100*(day+1)))
+		}
+		addTestSnapshot(t, da, bob, start, 999)
+
+		// both ends are included, and only alice's snapshots are hers
+		snapshots, err := da.GetSnapshotsByUser(context.Background(), alice.Id, start.AddDate(0, 0, 1), start.AddDate(0, 0, 2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(*snapshots) != 2 || (*snapshots)[0].NetWorth != 200 || (*snapshots)[1].NetWorth != 300 {
+			t.Fatalf("got %+v, want the snapshots of the 2nd and 3rd", *snapshots)
+		}
+		if items := (*snapshots)[0].Items; len(items) != 1 || items[0].Value != 200 {
+			t.Errorf("snapshot items %+v, want the house at 200", items)
+		}
+
+		// and a zero end has none
+		if count := countTestSnapshots(t, da, alice); count != 4 {
+			t.Errorf("%d snapshots with no end, want 4", count)
+		}
+	})
+}
+
+func TestSnapshotHistoryEndpoint(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.login(t, "alice")
+	user, err := api.da.FindUserByName(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestSnapshot(t, api.da, user, time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC), 100)
+	addTestSnapshot(t, api.da, user, time.Date(2020, 1, 2, 23, 30, 0, 0, time.UTC), 200)
+	addTestSnapshot(t, api.da, user, time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC), 300)
+
+	// a bare date at the end covers all of that day
+	var snapshots []SnapshotEntry
+	decodeTestBody(t, alice.expect(http.MethodGet, "/api/snapshots?from=2020-01-02&to=2020-01-02", nil, http.StatusOK), &snapshots)
+	if len(snapshots) != 1 || snapshots[0].NetWorth != 200 {
+		t.Errorf("got %+v, want only the snapshot of the 2nd", snapshots)
+	}
+
+	snapshots = nil
+	decodeTestBody(t, alice.expect(http.MethodGet, "/api/snapshots", nil, http.StatusOK), &snapshots)
+	if len(snapshots) != 3 || snapshots[0].NetWorth != 100 || snapshots[2].NetWorth != 300 {
+		t.Errorf("got %+v, want every snapshot oldest first", snapshots)
+	}
+
+	// other users don't see them
+	snapshots = nil
+	decodeTestBody(t, api.login(t, "bob").expect(http.MethodGet, "/api/snapshots", nil, http.StatusOK), &snapshots)
+	if len(snapshots) != 0 {
+		t.Errorf("bob sees %d snapshots", len(snapshots))
+	}
+
+	for _, parameters := range []string{"from=2020-01-03&to=2020-01-01", "from=yesterday"} {
+		content := alice.expect(http.MethodGet, "/api/snapshots?"+parameters, nil, http.StatusBadRequest)
+		expectErrorCode(t, content, "invalid_date")
+	}
+}
+
+func TestLatestSnapshotTime(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, da DataAccess) {
+		alice, bob := addTestUser(t, da, "alice"), addTestUser(t, da, "bob")
+		start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		for day := 0; day < 3; day++ {
+			addTestSnapshot(t, da, alice, start.AddDate(0, 0, day), 100)
+		}
+
+		for _, test := range []struct {
+			user   *UserEntry
+			before time.Time
+			want   time.Time
+		}{
+			{alice, start.AddDate(1, 0, 0), start.AddDate(0, 0, 2)},
+			{alice, start.AddDate(0, 0, 1), start.AddDate(0, 0, 1)},
+			{alice, start.Add(-time.Second), time.Time{}},
+			{bob, start.AddDate(1, 0, 0), time.Time{}},
+		} {
+			latest, err := da.GetLatestSnapshotTime(context.Background(), test.user.Id, test.before)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !latest.Equal(test.want) {
+				t.Errorf("latest for %s by %v was %v, want %v", test.user.Name, test.before, latest, test.want)
+			}
+		}
+	})
+}
+
+func TestPeriodicSnapshotsGoByTheLatestSnapshot(t *testing.T) {
+	da := openTestDataAccess(t, sqliteDialect.driver, filepath.Join(t.TempDir(), "test.db"), false)
+	recent, stale, none := addTestUser(t, da, "recent"), addTestUser(t, da, "stale"), addTestUser(t, da, "none")
+	addTestSnapshot(t, da, recent, time.Now().Add(-time.Hour), 100)
+	addTestSnapshot(t, da, stale, time.Now().Add(-30*time.Hour), 100)
+	// one from the future, such as an import might bring, doesn't put off the next
+	addTestSnapshot(t, da, stale, time.Now().Add(48*time.Hour), 100)
+
+	takeDueSnapshots(context.Background(), da, 24*time.Hour)
+	for user, want := range map[*UserEntry]int{recent: 1, stale: 3, none: 1} {
+		if count := countTestSnapshots(t, da, user); count != want {
+			t.Errorf("%s has %d snapshots, want %d", user.Name, count, want)
+		}
+	}
+
+	// everyone is now up to date, which is found without loading any snapshots
+	metrics := NewServerMetrics()
+	takeDueSnapshots(context.Background(), InstrumentDataAccess(da, metrics), 24*time.Hour)
+	if testMetricCount(metrics.dbLatency, "GetSnapshotsByUser") != 0 || testMetricCount(metrics.dbLatency, "GetLatestSnapshotTime") != 3 {
+		t.Error("checking who is due loaded their snapshots")
+	}
+	for user, want := range map[*UserEntry]int{recent: 1, stale: 3, none: 1} {
+		if count := countTestSnapshots(t, da, user); count != want {
+			t.Errorf("%s has %d snapshots after checking again, want %d", user.Name, count, want)
+		}
+	}
+}
+
+func TestPeriodicSnapshotsCheckWhenStarting(t *testing.T) {
+	// snapshots are counted while they are being taken, so wait out the lock
+	da := openTestDataAccess(t, sqliteDialect.driver, filepath.Join(t.TempDir(), "test.db")+"?_busy_timeout=5000", false)
+	user := addTestUser(t, da, "alice")
+
+	// the ticker is far off, so only the check at the start can take it
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runPeriodicSnapshots(ctx, da, 24*time.Hour, time.Hour)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for start := time.Now(); countTestSnapshots(t, da, user) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("no snapshot was taken on starting")
+		}
+	}
+}
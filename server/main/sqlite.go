@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// SQLite is our default engine, the database is a single local file
+// It only enforces foreign keys when asked to, on every connection
+var sqliteDialect = sqlDialect{
+	driver:          "sqlite3",
+	configure:       sqliteEndpoint,
+	foreignKeysOff:  "PRAGMA foreign_keys = OFF",
+	foreignKeysOn:   "PRAGMA foreign_keys = ON",
+	uniqueViolation: sqliteUniqueViolation,
+	migrations: []migration{
+		{
+			version:     1,
+			description: "create users and items",
+			statements: []string{`
+CREATE TABLE IF NOT EXISTS users (
+	uid  INTEGER PRIMARY KEY,
+	name TEXT UNIQUE
+)`, `
+CREATE TABLE IF NOT EXISTS items (
+	id    INTEGER PRIMARY KEY,
+	uid   INTEGER NOT NULL,
+	name  TEXT,
+	type  TEXT,
+	value BIGINT
+)`,
+			},
+		},
+		{
+			version:     2,
+			description: "add passwords and sessions",
+			statements: []string{`
+ALTER TABLE users ADD COLUMN password_hash TEXT`, `
+CREATE TABLE sessions (
+	token_hash TEXT PRIMARY KEY,
+	uid        INTEGER NOT NULL REFERENCES users(uid) ON DELETE CASCADE,
+	expires    BIGINT NOT NULL
+)`,
+			},
+		},
+		{
+			version:     3,
+			description: "add net worth snapshots",
+			statements: []string{`
+CREATE TABLE snapshots (
+	id              INTEGER PRIMARY KEY,
+	uid             INTEGER NOT NULL REFERENCES users(uid) ON DELETE CASCADE,
+	taken           BIGINT NOT NULL,
+	net_worth       BIGINT,
+	asset_total     BIGINT,
+	liability_total BIGINT
+)`, `
+CREATE TABLE snapshot_items (
+	snapshot_id INTEGER NOT NULL REFERENCES snapshots(id) ON DELETE CASCADE,
+	item_id     INTEGER NOT NULL,
+	name        TEXT,
+	type        TEXT,
+	value       BIGINT
+)`,
+			},
+		},
+		{
+			version:     4,
+			description: "add item value history",
+			statements: []string{`
+CREATE TABLE item_values (
+	id       INTEGER PRIMARY KEY,
+	item_id  INTEGER NOT NULL REFERENCES items(id) ON DELETE CASCADE,
+	value    BIGINT,
+	recorded BIGINT NOT NULL
+)`,
+			},
+		},
+		{
+			version:     5,
+			description: "add item categories and tags",
+			statements: []string{`
+ALTER TABLE items ADD COLUMN category TEXT NOT NULL DEFAULT 'other'`, `
+CREATE TABLE item_tags (
+	item_id INTEGER NOT NULL REFERENCES items(id) ON DELETE CASCADE,
+	tag     TEXT NOT NULL,
+	PRIMARY KEY (item_id, tag)
+)`,
+			},
+		},
+		{
+			version:     6,
+			description: "add currencies and exchange rates",
+			statements: []string{`
+ALTER TABLE items ADD COLUMN currency TEXT NOT NULL DEFAULT 'USD'`, `
+ALTER TABLE users ADD COLUMN base_currency TEXT NOT NULL DEFAULT 'USD'`, `
+ALTER TABLE snapshots ADD COLUMN currency TEXT NOT NULL DEFAULT 'USD'`, `
+CREATE TABLE exchange_rates (
+	currency  TEXT NOT NULL,
+	base      TEXT NOT NULL,
+	rate      REAL NOT NULL,
+	effective BIGINT NOT NULL,
+	PRIMARY KEY (currency, base, effective)
+)`,
+			},
+		},
+		{
+			version:     7,
+			description: "add item versions",
+			statements: []string{`
+ALTER TABLE items ADD COLUMN version INTEGER NOT NULL DEFAULT 1`, `
+ALTER TABLE items ADD COLUMN updated_at BIGINT NOT NULL DEFAULT 0`, `
+UPDATE items SET updated_at = COALESCE((SELECT MAX(recorded) FROM item_values WHERE item_values.item_id = items.id), 0)`,
+			},
+		},
+		{
+			version:            8,
+			description:        "add foreign keys from items to users",
+			withoutForeignKeys: true,
+			statements: []string{`
+DELETE FROM items WHERE uid NOT IN (SELECT uid FROM users)`, `
+DELETE FROM item_values WHERE item_id NOT IN (SELECT id FROM items)`, `
+DELETE FROM item_tags WHERE item_id NOT IN (SELECT id FROM items)`, `
+DELETE FROM sessions WHERE uid NOT IN (SELECT uid FROM users)`, `
+DELETE FROM snapshots WHERE uid NOT IN (SELECT uid FROM users)`, `
+DELETE FROM snapshot_items WHERE snapshot_id NOT IN (SELECT id FROM snapshots)`, `
+CREATE TABLE items_new (
+	id         INTEGER PRIMARY KEY,
+	uid        INTEGER NOT NULL REFERENCES users(uid) ON DELETE CASCADE,
+	name       TEXT,
+	type       TEXT,
+	value      BIGINT,
+	category   TEXT NOT NULL DEFAULT 'other',
+	currency   TEXT NOT NULL DEFAULT 'USD',
+	version    INTEGER NOT NULL DEFAULT 1,
+	updated_at BIGINT NOT NULL DEFAULT 0
+)`, `
+INSERT INTO items_new (id, uid, name, type, value, category, currency, version, updated_at)
+SELECT id, uid, name, type, value, category, currency, version, updated_at FROM items`, `
+DROP TABLE items`, `
+ALTER TABLE items_new RENAME TO items`, `
+CREATE INDEX items_uid ON items (uid)`,
+			},
+		},
+		{
+			version:     9,
+			description: "add profile settings",
+			statements: []string{`
+ALTER TABLE users ADD COLUMN display_name TEXT NOT NULL DEFAULT ''`, `
+ALTER TABLE users ADD COLUMN locale TEXT NOT NULL DEFAULT 'en-US'`, `
+ALTER TABLE users ADD COLUMN fiscal_year_start INTEGER NOT NULL DEFAULT 1`,
+			},
+		},
+		{
+			// migration 4 only made the table, so items from before it have no history yet
+			version:     10,
+			description: "record starting values for items without history",
+			statements: []string{`
+INSERT INTO item_values (item_id, value, recorded)
+SELECT id, value, CAST(strftime('%s', 'now') AS INTEGER) FROM items
+WHERE NOT EXISTS (SELECT 1 FROM item_values WHERE item_values.item_id = items.id)`,
+			},
+		},
+		{
+			// sqlite already compares text exactly, this keeps the versions in step with mysql
+			version:     11,
+			description: "compare user names and tags case sensitively",
+		},
+		{
+			// sqlite text is already utf-8 and compared exactly, this keeps the versions in step with mysql
+			version:     12,
+			description: "store all text as utf8mb4 and compare it exactly",
+		},
+		{
+			// the periodic snapshots look up each user's latest one
+			version:     13,
+			description: "index snapshots by user and time",
+			statements: []string{`
+CREATE INDEX snapshots_uid_taken ON snapshots (uid, taken)`,
+			},
+		},
+	},
+}
+
+func sqliteUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+// Switches on foreign key enforcement, unless the endpoint already says otherwise
+func sqliteEndpoint(endpoint string) string {
+	if strings.Contains(endpoint, "_foreign_keys=") || strings.Contains(endpoint, "_fk=") {
+		return endpoint
+	}
+	if strings.Contains(endpoint, "?") {
+		return endpoint + "&_foreign_keys=1"
+	}
+	return endpoint + "?_foreign_keys=1"
+}
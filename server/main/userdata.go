@@ -7,31 +7,84 @@ import (
 
 const (
 	insertUserCommand = `
-INSERT INTO users (name) VALUES ($1);	
+INSERT INTO users (name, password_hash) VALUES ($1, $2)
 `
 	findUserCommand = `
-SELECT * FROM users WHERE name = $1
+SELECT uid, name, COALESCE(password_hash, ''), base_currency, display_name, locale, fiscal_year_start
+FROM users WHERE name = $1
+`
+	findUserByIdCommand = `
+SELECT uid, name, COALESCE(password_hash, ''), base_currency, display_name, locale, fiscal_year_start
+FROM users WHERE uid = $1
 `
 	getUsersCommand = `
-SELECT * FROM users
+SELECT uid, name, base_currency, display_name, locale, fiscal_year_start FROM users
+`
+	updateUserCommand = `
+UPDATE users SET name = $1, display_name = $2, base_currency = $3, locale = $4, fiscal_year_start = $5
+WHERE uid = $6
+`
+	setPasswordHashCommand = `
+UPDATE users SET password_hash = $1 WHERE uid = $2
+`
+	deleteUserCommand = `
+DELETE FROM users WHERE uid = $1
 `
 )
 
+// Everything the user owns, removed before the user themselves
+// ON DELETE CASCADE would do the same, but sqlite only enforces it when foreign keys are
+// switched on, and an endpoint can switch them off
+var deleteUserOwnedCommands = []string{`
+DELETE FROM item_values WHERE item_id IN (SELECT id FROM items WHERE uid = $1)`, `
+DELETE FROM item_tags WHERE item_id IN (SELECT id FROM items WHERE uid = $1)`, `
+DELETE FROM items WHERE uid = $1`, `
+DELETE FROM snapshot_items WHERE snapshot_id IN (SELECT id FROM snapshots WHERE uid = $1)`, `
+DELETE FROM snapshots WHERE uid = $1`, `
+DELETE FROM sessions WHERE uid = $1`,
+}
+
 type UserEntry struct {
 	Id   int
 	Name string
+	// the password hash must never leave the server
+	PasswordHash string `json:"-"`
+	// every item is converted into this currency before it is totalled
+	BaseCurrency string
+	// how the user would like to be addressed, empty means by Name
+	DisplayName string
+	// a BCP 47 language tag, such as en-US, for clients to format numbers and dates with
+	Locale string
+	// the month, from 1 to 12, in which the user's financial year begins
+	FiscalYearStart int
 }
 
-func (da DataAccessSQL) AddUser(context context.Context, username string) error {
-	_, err := da.database.ExecContext(context, insertUserCommand, username)
+// Names are checked before adding or renaming a user, but a request running alongside can still
+// take the name in between, which the UNIQUE constraint then catches
+func (da DataAccessSQL) AddUser(context context.Context, username string, passwordHash string) error {
+	_, err := da.runner().ExecContext(context, da.bind(insertUserCommand), username, passwordHash)
+	if err != nil && da.dialect.uniqueViolation(err) {
+		return &UserAlreadyExistsError{Name: username}
+	}
 	return err
 }
 
 func (da DataAccessSQL) FindUserByName(context context.Context, username string) (*UserEntry, error) {
-	rows, err := da.database.QueryContext(context, findUserCommand, username)
+	return da.findUser(context, findUserCommand, username)
+}
+
+func (da DataAccessSQL) FindUserById(context context.Context, uid int) (*UserEntry, error) {
+	return da.findUser(context, findUserByIdCommand, uid)
+}
+
+// Helper method to run a query which should match a single user
+func (da DataAccessSQL) findUser(context context.Context, command string, arg interface{}) (*UserEntry, error) {
+	rows, err := da.runner().QueryContext(context, da.bind(command), arg)
 	// make sure to clean up rows when we're finished
 	defer func() {
-		rows.Close()
+		if rows != nil {
+			rows.Close()
+		}
 	}()
 
 	if err == sql.ErrNoRows {
@@ -49,25 +102,27 @@ func (da DataAccessSQL) FindUserByName(context context.Context, username string)
 		}
 
 		// scan the next row
-		var uid int
-		var uname string
-		err = rows.Scan(&uid, &uname)
+		var user UserEntry
+		err = rows.Scan(&user.Id, &user.Name, &user.PasswordHash, &user.BaseCurrency,
+			&user.DisplayName, &user.Locale, &user.FiscalYearStart)
 		if err != nil {
 			return nil, err
 		}
 
 		// return the first user we find (there should only be one...)
-		return &UserEntry{Id: uid, Name: uname}, nil
+		return &user, nil
 	}
 
 	return nil, nil
 }
 
 func (da DataAccessSQL) GetUsers(context context.Context) (*[]UserEntry, error) {
-	rows, err := da.database.QueryContext(context, getUsersCommand)
+	rows, err := da.runner().QueryContext(context, da.bind(getUsersCommand))
 	// make sure to clean up rows when we're finished
 	defer func() {
-		rows.Close()
+		if rows != nil {
+			rows.Close()
+		}
 	}()
 
 	users := make([]UserEntry, 0)
@@ -86,15 +141,55 @@ func (da DataAccessSQL) GetUsers(context context.Context) (*[]UserEntry, error)
 		}
 
 		// scan the next row
-		var uid int
-		var uname string
-		err = rows.Scan(&uid, &uname)
+		var user UserEntry
+		err = rows.Scan(&user.Id, &user.Name, &user.BaseCurrency, &user.DisplayName, &user.Locale, &user.FiscalYearStart)
 		if err != nil {
 			return &users, err
 		}
 
-		users = append(users, UserEntry{Id: uid, Name: uname})
+		users = append(users, user)
 	}
 
 	return &users, nil
 }
+
+func (da DataAccessSQL) UpdateUser(context context.Context, user *UserEntry) error {
+	_, err := da.runner().ExecContext(context, da.bind(updateUserCommand),
+		user.Name, user.DisplayName, user.BaseCurrency, user.Locale, user.FiscalYearStart, user.Id)
+	if err != nil && da.dialect.uniqueViolation(err) {
+		return &UserAlreadyExistsError{Name: user.Name}
+	}
+	return err
+}
+
+func (da DataAccessSQL) SetPasswordHash(context context.Context, uid int, passwordHash string) error {
+	_, err := da.runner().ExecContext(context, da.bind(setPasswordHashCommand), passwordHash, uid)
+	return err
+}
+
+func (da DataAccessSQL) DeleteUser(context context.Context, uid int) error {
+	tx, err := da.begin(context)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// clear out what the user owns first so nothing is left pointing at them
+	for _, command := range deleteUserOwnedCommands {
+		if _, err := tx.ExecContext(context, da.bind(command), uid); err != nil {
+			return err
+		}
+	}
+
+	result, err := tx.ExecContext(context, da.bind(deleteUserCommand), uid)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if deleted == 0 {
+		return &UserDoesNotExistError{Uid: &uid}
+	}
+
+	return tx.Commit()
+}
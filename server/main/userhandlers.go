@@ -3,20 +3,45 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"net/http"
+	"regexp"
 	"strconv"
+	"strings"
 	"unicode/utf8"
 )
 
+// A language, then optional script, region and variant subtags
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
 type userHandlers struct {
 	da DataAccess
 }
 
 type newUserRequest struct {
+	Name     string
+	Password string
+}
+
+// What anyone can see of a user, listing the users needs no session so it leaves the profile out
+type UserSummary struct {
+	Id   int
 	Name string
 }
 
+// A change to a user's name or profile settings, fields left out (or null) stay as they are
+type ProfileUpdate struct {
+	Name            *string
+	DisplayName     *string
+	BaseCurrency    *string
+	Locale          *string
+	FiscalYearStart *int
+}
+
+// Deleting an account is only done with the password to hand, so a stolen session can't do it
+type deleteUserRequest struct {
+	Password string
+}
+
 type InvalidUserNameError struct {
 	Name   string
 	Reason string
@@ -26,6 +51,31 @@ func (err *InvalidUserNameError) Error() string {
 	return err.Name + " is an invalid name: " + err.Reason
 }
 
+type InvalidDisplayNameError struct {
+	DisplayName string
+	Reason      string
+}
+
+func (err *InvalidDisplayNameError) Error() string {
+	return err.DisplayName + " is an invalid display name: " + err.Reason
+}
+
+type InvalidLocaleError struct {
+	Locale string
+}
+
+func (err *InvalidLocaleError) Error() string {
+	return "'" + err.Locale + "' is an invalid locale: Must be a language tag such as en-US"
+}
+
+type InvalidFiscalYearStartError struct {
+	Month int
+}
+
+func (err *InvalidFiscalYearStartError) Error() string {
+	return strconv.Itoa(err.Month) + " is an invalid fiscal year start: Must be a month from 1 to 12"
+}
+
 type UserDoesNotExistError struct {
 	Name *string
 	Uid  *int
@@ -40,81 +90,252 @@ func (err *UserDoesNotExistError) Error() string {
 	return "The user could not be found."
 }
 
+type UserAlreadyExistsError struct {
+	Name string
+}
+
+func (err *UserAlreadyExistsError) Error() string {
+	return "There is already a user named '" + err.Name + "'."
+}
+
+type UserForbiddenError struct {
+	Name string
+}
+
+func (err *UserForbiddenError) Error() string {
+	return "You do not have permission to access the user '" + err.Name + "'."
+}
+
 // Find a user given their username
-func FindUserByName(da DataAccess, name string) (*UserEntry, error) {
+func FindUserByName(context context.Context, da DataAccess, name string) (*UserEntry, error) {
 	// find the user and verify they exist
-	user, err := da.FindUserByName(context.Background(), name)
-	if err != nil || user == nil {
+	user, err := da.FindUserByName(context, name)
+	if err != nil {
+		return nil, err
+	} else if user == nil {
 		return nil, &UserDoesNotExistError{Name: &name, Uid: nil}
 	}
 	return user, nil
 }
 
-// Perform validation and add a new user
-func AddUser(da DataAccess, name string) error {
-	// ensure the name is properly sized
+// Helper method to check a user name is properly sized
+func validateUserName(name string) error {
 	namelen := utf8.RuneCountInString(name)
 	if namelen <= 1 {
 		return &InvalidUserNameError{Name: name, Reason: "Must be longer than 1 character."}
 	} else if namelen >= 64 {
 		return &InvalidUserNameError{Name: name, Reason: "Must be shorter than 64 characters."}
 	}
+	return nil
+}
+
+// Helper method to verify a locale looks like a BCP 47 language tag and give it the usual casing,
+// a lower case language, a title case script and an upper case region (e.g. zh-Hant-TW)
+func normalizeLocale(locale string) (string, error) {
+	trimmed := strings.TrimSpace(locale)
+	if !localePattern.MatchString(trimmed) {
+		return "", &InvalidLocaleError{Locale: locale}
+	}
+
+	subtags := strings.Split(strings.ToLower(trimmed), "-")
+	for i := 1; i < len(subtags); i++ {
+		if len(subtags[i]) == 4 {
+			subtags[i] = strings.ToUpper(subtags[i][:1]) + subtags[i][1:]
+		} else if len(subtags[i]) == 2 {
+			subtags[i] = strings.ToUpper(subtags[i])
+		}
+	}
+	return strings.Join(subtags, "-"), nil
+}
+
+// Perform validation and add a new user
+func AddUser(context context.Context, da DataAccess, name string, password string) error {
+	if err := validateUserName(name); err != nil {
+		return err
+	}
 
 	// ensure the name is unique
-	user, err := da.FindUserByName(context.Background(), name)
+	user, err := da.FindUserByName(context, name)
 	if user != nil {
-		return &InvalidUserNameError{Name: name, Reason: "There is already a user by that name."}
+		return &UserAlreadyExistsError{Name: name}
 	} else if err != nil {
 		return err
 	}
 
+	// ensure the password is acceptable before we spend time hashing it
+	if err := validatePassword(password); err != nil {
+		return err
+	}
+	passwordHash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
 	// try to add the new user
-	return da.AddUser(context.Background(), name)
+	return da.AddUser(context, name, passwordHash)
+}
+
+// Perform validation and change a user's name or profile settings
+// A new name goes through the same checks as when adding a user, and returns the user as stored
+func UpdateProfile(context context.Context, da DataAccess, user *UserEntry, update *ProfileUpdate) (*UserEntry, error) {
+	changed := *user
+	if update.Name != nil {
+		if err := validateUserName(*update.Name); err != nil {
+			return nil, err
+		}
+		changed.Name = *update.Name
+	}
+	if update.DisplayName != nil {
+		changed.DisplayName = strings.TrimSpace(*update.DisplayName)
+		if utf8.RuneCountInString(changed.DisplayName) >= 64 {
+			return nil, &InvalidDisplayNameError{DisplayName: *update.DisplayName, Reason: "Must be shorter than 64 characters."}
+		}
+	}
+	if update.BaseCurrency != nil {
+		currency, err := normalizeCurrency(*update.BaseCurrency)
+		if err != nil {
+			return nil, err
+		}
+		changed.BaseCurrency = currency
+	}
+	if update.Locale != nil {
+		locale, err := normalizeLocale(*update.Locale)
+		if err != nil {
+			return nil, err
+		}
+		changed.Locale = locale
+	}
+	if update.FiscalYearStart != nil {
+		if *update.FiscalYearStart < 1 || *update.FiscalYearStart > 12 {
+			return nil, &InvalidFiscalYearStartError{Month: *update.FiscalYearStart}
+		}
+		changed.FiscalYearStart = *update.FiscalYearStart
+	}
+
+	err := da.WithTransaction(context, func(tx DataAccess) error {
+		// ensure the new name is unique
+		if changed.Name != user.Name {
+			existing, err := tx.FindUserByName(context, changed.Name)
+			if existing != nil {
+				return &UserAlreadyExistsError{Name: changed.Name}
+			} else if err != nil {
+				return err
+			}
+		}
+
+		return tx.UpdateUser(context, &changed)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return da.FindUserById(context, user.Id)
+}
+
+// Permanently removes a user along with their items, history, snapshots and sessions
+// The password is checked again first, as there is no undoing this
+func DeleteUser(context context.Context, da DataAccess, user *UserEntry, password string) error {
+	if err := checkPassword(user, password); err != nil {
+		return err
+	}
+
+	return da.DeleteUser(context, user.Id)
 }
 
 // Handle http requests for the user API
 func (uh userHandlers) UserRequestHandler(writer http.ResponseWriter, request *http.Request) {
-	writer.Header().Set("Content-Type", "application/json")
-	writer.Header().Set("Access-Control-Allow-Origin", "*")
-	writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-	writer.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	writeAPIHeaders(writer, request)
 
 	switch request.Method {
 	case http.MethodOptions:
 		return
 	case http.MethodGet:
-		// return a json of the users
-		users, err := uh.da.GetUsers(context.Background())
+		// return a json of the users' names, the rest of a profile is only for its owner
+		users, err := uh.da.GetUsers(request.Context())
 		if err != nil {
-			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			writeError(writer, request, err)
 			return
 		}
+		summaries := make([]UserSummary, len(*users))
+		for i, user := range *users {
+			summaries[i] = UserSummary{Id: user.Id, Name: user.Name}
+		}
 
 		writer.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(writer).Encode(users)
+		json.NewEncoder(writer).Encode(summaries)
 	case http.MethodPost:
 		// add a user and return success or failure
 		var userRequest newUserRequest
 		err := json.NewDecoder(request.Body).Decode(&userRequest)
 		if err != nil {
-			http.Error(writer, err.Error(), http.StatusBadRequest)
+			writeError(writer, request, &InvalidRequestError{Reason: err.Error()})
 			return
 		}
-		fmt.Println("Got new user request for name '" + userRequest.Name + "'")
+		logDebug(request.Context(), "Got new user request", sensitiveField("user", userRequest.Name))
 
-		err = AddUser(uh.da, userRequest.Name)
+		err = AddUser(request.Context(), uh.da, userRequest.Name, userRequest.Password)
 		if err != nil {
-			fmt.Println("Failed to add user: " + err.Error())
-			http.Error(writer, err.Error(), http.StatusBadRequest)
+			logWarn(request.Context(), "Failed to add user", errorField(err))
+			writeError(writer, request, err)
 			return
 		}
 
 		// respond with the new user info
-		user, err := uh.da.FindUserByName(context.Background(), userRequest.Name)
+		user, err := uh.da.FindUserByName(request.Context(), userRequest.Name)
 
 		writer.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(writer).Encode(user)
 	default:
-		http.Error(writer, "Invalid request method.", 405)
+		writeError(writer, request, &MethodNotAllowedError{Method: request.Method})
+	}
+}
+
+// Handle http requests for the logged in user's own profile
+func (uh userHandlers) ProfileRequestHandler(writer http.ResponseWriter, request *http.Request) {
+	writeAPIHeaders(writer, request)
+
+	user := requestUser(request)
+	switch request.Method {
+	case http.MethodOptions:
+		return
+	case http.MethodGet:
+		json.NewEncoder(writer).Encode(user)
+	case http.MethodPut:
+		// only the fields which are sent are changed
+		var update ProfileUpdate
+		err := json.NewDecoder(request.Body).Decode(&update)
+		if err != nil {
+			writeError(writer, request, &InvalidRequestError{Reason: err.Error()})
+			return
+		}
+
+		// respond with the updated user info
+		user, err = UpdateProfile(request.Context(), uh.da, user, &update)
+		if err != nil {
+			logWarn(request.Context(), "Failed to update profile", errorField(err))
+			writeError(writer, request, err)
+			return
+		}
+		json.NewEncoder(writer).Encode(user)
+	case http.MethodDelete:
+		var deleteRequest deleteUserRequest
+		err := json.NewDecoder(request.Body).Decode(&deleteRequest)
+		if err != nil {
+			writeError(writer, request, &InvalidRequestError{Reason: err.Error()})
+			return
+		}
+
+		err = DeleteUser(request.Context(), uh.da, user, deleteRequest.Password)
+		if err != nil {
+			logWarn(request.Context(), "Failed to delete user", errorField(err))
+			writeError(writer, request, err)
+			return
+		}
+
+		// the sessions went with the user
+		clearSessionCookie(writer)
+		writer.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(writer, request, &MethodNotAllowedError{Method: request.Method})
 	}
 }
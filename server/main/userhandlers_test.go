@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// Helper method to get the profile of the client's user
+func getTestProfile(client *testClient) *UserEntry {
+	client.t.Helper()
+	var user UserEntry
+	decodeTestBody(client.t, client.expect(http.MethodGet, "/api/profile", nil, http.StatusOK), &user)
+	return &user
+}
+
+func TestProfileRename(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.login(t, "alice")
+	api.login(t, "bob")
+
+	var user UserEntry
+	decodeTestBody(t, alice.expect(http.MethodPut, "/api/profile", map[string]string{"Name": "alicia"}, http.StatusOK), &user)
+	if user.Name != "alicia" {
+		t.Fatalf("renamed to %q, want alicia", user.Name)
+	}
+
+	// the session carries on, and the new name is the one to log in with
+	if user := getTestProfile(alice); user.Name != "alicia" {
+		t.Errorf("session user is %q after renaming", user.Name)
+	}
+	credentials := map[string]string{"Name": "alice", "Password": "password123"}
+	api.anonymous(t).expect(http.MethodPost, "/api/login", credentials, http.StatusUnauthorized)
+	credentials["Name"] = "alicia"
+	api.anonymous(t).expect(http.MethodPost, "/api/login", credentials, http.StatusOK)
+
+	// names are unique, though only exactly
+	content := alice.expect(http.MethodPut, "/api/profile", map[string]string{"Name": "bob"}, http.StatusConflict)
+	expectErrorCode(t, content, "user_already_exists")
+	alice.expect(http.MethodPut, "/api/profile", map[string]string{"Name": "Bob"}, http.StatusOK)
+
+	content = alice.expect(http.MethodPut, "/api/profile", map[string]string{"Name": "x"}, http.StatusBadRequest)
+	expectErrorCode(t, content, "invalid_user_name")
+	if user := getTestProfile(alice); user.Name != "Bob" {
+		t.Errorf("failed renames left the name as %q", user.Name)
+	}
+}
+
+func TestV2RenameMovesTheUser(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.login(t, "alice")
+	api.login(t, "bob")
+
+	response, _ := alice.do(http.MethodPatch, "/api/v2/users/alice", map[string]string{"Name": "alicia"})
+	if response.StatusCode != http.StatusOK || response.Header.Get("Location") != "/api/v2/users/alicia" {
+		t.Fatalf("rename gave %d with Location %q", response.StatusCode, response.Header.Get("Location"))
+	}
+	alice.expect(http.MethodGet, "/api/v2/users/alicia", nil, http.StatusOK)
+
+	content := alice.expect(http.MethodPatch, "/api/v2/users/alicia", map[string]string{"Name": "bob"}, http.StatusConflict)
+	expectErrorCode(t, content, "user_already_exists")
+}
+
+func TestProfileSettings(t *testing.T) {
+	alice := newTestAPI(t).login(t, "alice")
+
+	var user UserEntry
+	decodeTestBody(t, alice.expect(http.MethodPut, "/api/profile", map[string]interface{}{"DisplayName": " Alice A. ",
+		"BaseCurrency": "eur", "Locale": "zh-hant-tw", "FiscalYearStart": 4}, http.StatusOK), &user)
+	if user.DisplayName != "Alice A." || user.BaseCurrency != "EUR" || user.Locale != "zh-Hant-TW" || user.FiscalYearStart != 4 {
+		t.Errorf("saved %+v", user)
+	}
+
+	for _, test := range []struct {
+		update map[string]interface{}
+		code   string
+	}{
+		{map[string]interface{}{"FiscalYearStart": 13}, "invalid_fiscal_year_start"},
+		{map[string]interface{}{"Locale": "not a locale"}, "invalid_locale"},
+		{map[string]interface{}{"BaseCurrency": "euro"}, "invalid_currency"},
+	} {
+		content := alice.expect(http.MethodPut, "/api/profile", test.update, http.StatusBadRequest)
+		expectErrorCode(t, content, test.code)
+	}
+
+	// nothing was changed by the failures, nor by leaving fields out
+	alice.expect(http.MethodPut, "/api/profile", map[string]interface{}{}, http.StatusOK)
+	if saved := getTestProfile(alice); saved.DisplayName != "Alice A." || saved.BaseCurrency != "EUR" ||
+		saved.Locale != "zh-Hant-TW" || saved.FiscalYearStart != 4 || saved.Name != "alice" {
+		t.Errorf("profile is now %+v", saved)
+	}
+}
+
+// Helper method to count the rows in every table a user's things are kept in
+func countTestUserRows(t *testing.T, da DataAccess) map[string]int {
+	t.Helper()
+	counts := make(map[string]int)
+	for _, table := range append(userOwnedTables, "users") {
+		counts[table] = countTestRows(t, da, table)
+	}
+	return counts
+}
+
+func TestDeletingAnAccountNeedsThePassword(t *testing.T) {
+	api := newTestAPI(t)
+	addTestItem(api.login(t, "bob"), "Bike", 50)
+	withoutAlice := countTestUserRows(t, api.da)
+
+	alice := api.login(t, "alice")
+	item := addTestItem(alice, "House", 500)
+	alice.expect(http.MethodPut, "/api/item", map[string]interface{}{"Id": item.Id, "Name": "House",
+		"ItemType": ItemTypeAsset, "Value": 600, "Tags": []string{"home"}, "Version": 1}, http.StatusOK)
+	alice.expect(http.MethodPost, "/api/snapshot", nil, http.StatusOK)
+	withAlice := countTestUserRows(t, api.da)
+
+	// a stolen session alone can't remove the account, through either api
+	for _, attempt := range []struct {
+		path string
+		body interface{}
+	}{
+		{"/api/profile", map[string]string{"Password": "wrong password"}},
+		{"/api/profile", map[string]string{}},
+		{"/api/v2/users/alice", map[string]string{"Password": "wrong password"}},
+		{"/api/v2/users/alice", map[string]string{}},
+	} {
+		content := alice.expect(http.MethodDelete, attempt.path, attempt.body, http.StatusUnauthorized)
+		expectErrorCode(t, content, "invalid_credentials")
+	}
+	if counts := countTestUserRows(t, api.da); !reflect.DeepEqual(counts, withAlice) {
+		t.Fatalf("failed deletes changed the rows from %v to %v", withAlice, counts)
+	}
+	getTestProfile(alice)
+
+	// the right password takes everything of theirs with it, and nothing of anyone else's
+	response, content := alice.do(http.MethodDelete, "/api/profile", map[string]string{"Password": "password123"})
+	if response.StatusCode != http.StatusNoContent {
+		t.Fatalf("deleting gave %d: %s", response.StatusCode, content)
+	}
+	if cookie := findSessionCookie(response); cookie == nil || cookie.MaxAge >= 0 {
+		t.Error("deleting did not clear the session cookie")
+	}
+	if counts := countTestUserRows(t, api.da); !reflect.DeepEqual(counts, withoutAlice) {
+		t.Errorf("deleting left the rows at %v, want %v", counts, withoutAlice)
+	}
+	api.anonymous(t).expect(http.MethodPost, "/api/login", map[string]string{"Name": "alice", "Password": "password123"},
+		http.StatusUnauthorized)
+}
+
+func TestV2DeleteRemovesTheUser(t *testing.T) {
+	api := newTestAPI(t)
+	withoutAlice := countTestUserRows(t, api.da)
+	alice := api.login(t, "alice")
+	addTestItem(alice, "House", 500)
+
+	alice.expect(http.MethodDelete, "/api/v2/users/alice", map[string]string{"Password": "password123"}, http.StatusNoContent)
+	if counts := countTestUserRows(t, api.da); !reflect.DeepEqual(counts, withoutAlice) {
+		t.Errorf("deleting left the rows at %v, want %v", counts, withoutAlice)
+	}
+	alice.expect(http.MethodGet, "/api/profile", nil, http.StatusUnauthorized)
+}
+
+// A DataAccess which never finds a user by name, as if another request took the name
+// between the uniqueness check and the write
+type staleNameLookups struct {
+	DataAccess
+}
+
+func (da staleNameLookups) FindUserByName(context context.Context, name string) (*UserEntry, error) {
+	return nil, nil
+}
+
+func (da staleNameLookups) WithTransaction(context context.Context, work func(DataAccess) error) error {
+	return da.DataAccess.WithTransaction(context, func(tx DataAccess) error {
+		return work(staleNameLookups{tx})
+	})
+}
+
+func TestNamesTakenInTheMeantimeAreConflicts(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, da DataAccess) {
+		addTestUser(t, da, "alice")
+		bob := addTestUser(t, da, "bob")
+		taken := "alice"
+
+		_, err := UpdateProfile(context.Background(), staleNameLookups{da}, bob, &ProfileUpdate{Name: &taken})
+		var exists *UserAlreadyExistsError
+		if !errors.As(err, &exists) {
+			t.Fatalf("renaming onto a taken name gave %v, want a UserAlreadyExistsError", err)
+		}
+		if status, response := describeError(err); status != http.StatusConflict || response.Code != "user_already_exists" {
+			t.Errorf("the conflict is described as %d %s", status, response.Code)
+		}
+
+		if err := AddUser(context.Background(), staleNameLookups{da}, "alice", "password123"); !errors.As(err, &exists) {
+			t.Errorf("adding a taken name gave %v, want a UserAlreadyExistsError", err)
+		}
+	})
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const v2Prefix = "/api/v2/"
+
+type v2Handlers struct {
+	da DataAccess
+}
+
+// The body of a v2 create or replace, it mirrors ItemEntry
+type v2ItemRequest struct {
+	Name     string
+	Type     string
+	Category string
+	Currency string
+	Value    int64
+	Tags     []string
+	// the version a replace is based on, unless an If-Match header is sent
+	Version int
+}
+
+// Helper method to decode a v2 request body, unknown fields are rejected
+// so that misspelt fields are not silently dropped
+func decodeV2Body(request *http.Request, body interface{}) error {
+	decoder := json.NewDecoder(request.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(body); err != nil {
+		return &InvalidRequestError{Reason: err.Error()}
+	}
+	return nil
+}
+
+// Helper method to respond with a method not allowed, naming the methods which are
+func writeV2MethodNotAllowed(writer http.ResponseWriter, request *http.Request, allowed string) {
+	writer.Header().Set("Allow", allowed)
+	writeError(writer, request, &MethodNotAllowedError{Method: request.Method})
+}
+
+// Helper method to split the path after /api/v2/ into its unescaped segments
+func v2PathSegments(request *http.Request) ([]string, error) {
+	path := strings.Trim(strings.TrimPrefix(request.URL.EscapedPath(), v2Prefix), "/")
+	segments := strings.Split(path, "/")
+	for i := range segments {
+		segment, err := url.PathUnescape(segments[i])
+		if err != nil {
+			return nil, err
+		}
+		segments[i] = segment
+	}
+	return segments, nil
+}
+
+// Handles every incoming http request under /api/v2/
+// The resource is picked from the path and then the method decides what to do with it:
+//
+//	GET, PATCH, DELETE      /users/{name}
+//	GET, POST               /users/{name}/items
+//	GET, PUT, PATCH, DELETE /items/{id}
+//	GET                     /items/{id}/history
+//
+// Creating, replacing or patching an item responds with an ItemChange, the
+// stored item along with the user's recomputed totals, as the v1 endpoints do
+func (vh v2Handlers) RequestHandler(writer http.ResponseWriter, request *http.Request) {
+	writeAPIHeaders(writer, request)
+	if request.Method == http.MethodOptions {
+		return
+	}
+
+	segments, err := v2PathSegments(request)
+	if err != nil {
+		writeError(writer, request, &RouteDoesNotExistError{Path: request.URL.Path})
+		return
+	}
+
+	switch {
+	case len(segments) == 2 && segments[0] == "users":
+		vh.userHandler(writer, request, segments[1])
+	case len(segments) == 3 && segments[0] == "users" && segments[2] == "items":
+		vh.userItemsHandler(writer, request, segments[1])
+	case len(segments) >= 2 && len(segments) <= 3 && segments[0] == "items":
+		id, err := strconv.Atoi(segments[1])
+		if err != nil {
+			writeError(writer, request, &RouteDoesNotExistError{Path: request.URL.Path})
+			return
+		}
+
+		if len(segments) == 2 {
+			vh.itemHandler(writer, request, id)
+		} else if segments[2] == "history" {
+			vh.itemHistoryHandler(writer, request, id)
+		} else {
+			writeError(writer, request, &RouteDoesNotExistError{Path: request.URL.Path})
+		}
+	default:
+		writeError(writer, request, &RouteDoesNotExistError{Path: request.URL.Path})
+	}
+}
+
+// Helper method to check that a user named in the path is the logged in user
+// Users which are missing are told apart from those which belong to someone else
+func (vh v2Handlers) checkPathUser(request *http.Request, name string) error {
+	if name == requestUser(request).Name {
+		return nil
+	}
+
+	_, err := FindUserByName(request.Context(), vh.da, name)
+	if err == nil {
+		err = &UserForbiddenError{Name: name}
+	}
+	return err
+}
+
+// Handles a user's account and profile, only the logged in user's own is reachable
+func (vh v2Handlers) userHandler(writer http.ResponseWriter, request *http.Request, name string) {
+	if err := vh.checkPathUser(request, name); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		json.NewEncoder(writer).Encode(requestUser(request))
+	case http.MethodPatch:
+		// only the fields which are sent are changed, including the name
+		var update ProfileUpdate
+		if err := decodeV2Body(request, &update); err != nil {
+			writeError(writer, request, err)
+			return
+		}
+
+		user, err := UpdateProfile(request.Context(), vh.da, requestUser(request), &update)
+		if err != nil {
+			logWarn(request.Context(), "Failed to update user", errorField(err))
+			writeError(writer, request, err)
+			return
+		}
+
+		// a renamed user lives at a new path
+		if user.Name != name {
+			writer.Header().Set("Location", v2Prefix+"users/"+url.PathEscape(user.Name))
+		}
+		json.NewEncoder(writer).Encode(user)
+	case http.MethodDelete:
+		var deleteRequest deleteUserRequest
+		if err := decodeV2Body(request, &deleteRequest); err != nil {
+			writeError(writer, request, err)
+			return
+		}
+
+		if err := DeleteUser(request.Context(), vh.da, requestUser(request), deleteRequest.Password); err != nil {
+			logWarn(request.Context(), "Failed to delete user", errorField(err))
+			writeError(writer, request, err)
+			return
+		}
+
+		clearSessionCookie(writer)
+		writer.WriteHeader(http.StatusNoContent)
+	default:
+		writeV2MethodNotAllowed(writer, request, "GET, PATCH, DELETE, OPTIONS")
+	}
+}
+
+// Handles the collection of a user's items, only the logged in user's own items are reachable
+func (vh v2Handlers) userItemsHandler(writer http.ResponseWriter, request *http.Request, name string) {
+	if err := vh.checkPathUser(request, name); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	user := requestUser(request)
+
+	switch request.Method {
+	case http.MethodGet:
+		query, err := parseItemQuery(request.URL.Query())
+		if err != nil {
+			writeError(writer, request, err)
+			return
+		}
+
+		itemList, err := GetItems(request.Context(), vh.da, user, query)
+		if err != nil {
+			logWarn(request.Context(), "Failed to get items", errorField(err))
+			writeError(writer, request, err)
+			return
+		}
+
+		json.NewEncoder(writer).Encode(itemList)
+	case http.MethodPost:
+		var itemRequest v2ItemRequest
+		if err := decodeV2Body(request, &itemRequest); err != nil {
+			writeError(writer, request, err)
+			return
+		}
+
+		item := ItemEntry{Name: itemRequest.Name, Type: itemRequest.Type, Category: itemRequest.Category,
+			Currency: itemRequest.Currency, Value: itemRequest.Value, Tags: itemRequest.Tags}
+		stored, err := AddItem(request.Context(), vh.da, user, &item)
+		if err != nil {
+			logWarn(request.Context(), "Failed to add item", errorField(err))
+			writeError(writer, request, err)
+			return
+		}
+
+		writer.Header().Set("Location", v2Prefix+"items/"+strconv.Itoa(stored.Id))
+		writer.Header().Set("ETag", itemETag(stored))
+		writer.WriteHeader(http.StatusCreated)
+		json.NewEncoder(writer).Encode(itemChange(request.Context(), vh.da, user, stored))
+	default:
+		writeV2MethodNotAllowed(writer, request, "GET, POST, OPTIONS")
+	}
+}
+
+// Handles a single item belonging to the logged in user
+func (vh v2Handlers) itemHandler(writer http.ResponseWriter, request *http.Request, id int) {
+	user := requestUser(request)
+
+	switch request.Method {
+	case http.MethodGet:
+		item, err := findOwnedItem(request.Context(), vh.da, user, id)
+		if err != nil {
+			writeError(writer, request, err)
+			return
+		}
+
+		writer.Header().Set("ETag", itemETag(item))
+		json.NewEncoder(writer).Encode(item)
+	case http.MethodPut:
+		// replace every field of the item
+		var itemRequest v2ItemRequest
+		if err := decodeV2Body(request, &itemRequest); err != nil {
+			writeError(writer, request, err)
+			return
+		}
+
+		version, fromHeader, err := requestItemVersion(request, itemRequest.Version)
+		if err != nil {
+			writeError(writer, request, err)
+			return
+		}
+
+		item := ItemEntry{Id: id, Name: itemRequest.Name, Type: itemRequest.Type, Category: itemRequest.Category,
+			Currency: itemRequest.Currency, Value: itemRequest.Value, Tags: itemRequest.Tags, Version: version}
+		stored, err := UpdateItem(request.Context(), vh.da, user, &item)
+		if err != nil {
+			logWarn(request.Context(), "Failed to update item", errorField(err))
+			writeError(writer, request, versionError(err, fromHeader))
+			return
+		}
+
+		writer.Header().Set("ETag", itemETag(stored))
+		json.NewEncoder(writer).Encode(itemChange(request.Context(), vh.da, user, stored))
+	case http.MethodPatch:
+		// apply a JSON Merge Patch, only the fields it names change
+		patch, bodyVersion, err := readItemPatch(request.Body)
+		if err != nil {
+			writeError(writer, request, err)
+			return
+		}
+		version, fromHeader, err := requestItemVersion(request, bodyVersion)
+		if err != nil {
+			writeError(writer, request, err)
+			return
+		}
+
+		stored, err := PatchItem(request.Context(), vh.da, user, id, patch, version)
+		if err != nil {
+			logWarn(request.Context(), "Failed to patch item", errorField(err))
+			writeError(writer, request, versionError(err, fromHeader))
+			return
+		}
+
+		writer.Header().Set("ETag", itemETag(stored))
+		json.NewEncoder(writer).Encode(itemChange(request.Context(), vh.da, user, stored))
+	case http.MethodDelete:
+		// there is no body, so the version can only come from If-Match
+		version, fromHeader, err := requestItemVersion(request, 0)
+		if err != nil {
+			writeError(writer, request, err)
+			return
+		}
+
+		if err := DeleteItem(request.Context(), vh.da, user, id, version); err != nil {
+			logWarn(request.Context(), "Failed to delete item", errorField(err))
+			writeError(writer, request, versionError(err, fromHeader))
+			return
+		}
+
+		writer.WriteHeader(http.StatusNoContent)
+	default:
+		writeV2MethodNotAllowed(writer, request, "GET, PUT, PATCH, DELETE, OPTIONS")
+	}
+}
+
+// Handles the valuation history of a single item belonging to the logged in user
+func (vh v2Handlers) itemHistoryHandler(writer http.ResponseWriter, request *http.Request, id int) {
+	switch request.Method {
+	case http.MethodGet:
+		history, err := GetItemHistory(request.Context(), vh.da, requestUser(request), id)
+		if err != nil {
+			writeError(writer, request, err)
+			return
+		}
+
+		json.NewEncoder(writer).Encode(history)
+	default:
+		writeV2MethodNotAllowed(writer, request, "GET, OPTIONS")
+	}
+}
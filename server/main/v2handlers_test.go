@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestV2ItemsCannotBeReachedByOtherUsers(t *testing.T) {
+	api := newTestAPI(t)
+	item := addTestItem(api.login(t, "alice"), "House", 500)
+	bob := api.login(t, "bob")
+	path := "/api/v2/items/" + strconv.Itoa(item.Id)
+
+	for _, attempt := range []struct {
+		method string
+		path   string
+		body   interface{}
+	}{
+		{http.MethodGet, path, nil},
+		{http.MethodPut, path, map[string]interface{}{"Name": "Mine", "Type": ItemTypeAsset, "Value": 1, "Version": 1}},
+		{http.MethodPatch, path, map[string]interface{}{"Value": 1, "Version": 1}},
+		{http.MethodDelete, path, nil},
+		{http.MethodGet, path + "/history", nil},
+	} {
+		content := bob.expect(attempt.method, attempt.path, attempt.body, http.StatusForbidden, "If-Match", `"1"`)
+		expectErrorCode(t, content, "item_forbidden")
+	}
+
+	// nor through alice's own paths
+	content := bob.expect(http.MethodGet, "/api/v2/users/alice/items", nil, http.StatusForbidden)
+	expectErrorCode(t, content, "user_forbidden")
+	content = bob.expect(http.MethodPost, "/api/v2/users/alice/items",
+		map[string]interface{}{"Name": "Mine", "Type": ItemTypeAsset, "Value": 1}, http.StatusForbidden)
+	expectErrorCode(t, content, "user_forbidden")
+
+	expectItemUnchanged(t, api.da, item)
+}
+
+func TestV2WritesReturnTotals(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.login(t, "alice")
+	addTestItem(alice, "Cash", 100)
+
+	var change ItemChange
+	content := alice.expect(http.MethodPost, "/api/v2/users/alice/items",
+		map[string]interface{}{"Name": "Loan", "Type": ItemTypeLiability, "Value": 30}, http.StatusCreated)
+	decodeTestBody(t, content, &change)
+	if change.Item == nil || change.Totals == nil || change.Totals.NetWorth != 70 {
+		t.Fatalf("create gave %s, want the item and a net worth of 70", content)
+	}
+	path := "/api/v2/items/" + strconv.Itoa(change.Item.Id)
+
+	change = ItemChange{}
+	content = alice.expect(http.MethodPut, path,
+		map[string]interface{}{"Name": "Loan", "Type": ItemTypeLiability, "Value": 50, "Version": 1}, http.StatusOK)
+	decodeTestBody(t, content, &change)
+	if change.Totals == nil || change.Totals.NetWorth != 50 || change.Totals.LiabilityTotal != 50 {
+		t.Errorf("replace gave %s, want a net worth of 50", content)
+	}
+
+	change = ItemChange{}
+	content = alice.expect(http.MethodPatch, path, map[string]interface{}{"Value": 10}, http.StatusOK, "If-Match", `"2"`)
+	decodeTestBody(t, content, &change)
+	if change.Totals == nil || change.Totals.NetWorth != 90 || change.Item.Version != 3 {
+		t.Errorf("patch gave %s, want a net worth of 90 at version 3", content)
+	}
+}
+
+// Helper method to patch an item through v2, giving the stored item
+func patchTestItem(client *testClient, path string, patch interface{}, headers ...string) *ItemEntry {
+	client.t.Helper()
+	var change ItemChange
+	decodeTestBody(client.t, client.expect(http.MethodPatch, path, patch, http.StatusOK, headers...), &change)
+	return change.Item
+}
+
+func TestV2PatchMergesFields(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.login(t, "alice")
+	var change ItemChange
+	decodeTestBody(t, alice.expect(http.MethodPost, "/api/v2/users/alice/items", map[string]interface{}{"Name": "Car",
+		"Type": ItemTypeAsset, "Category": ItemCategoryVehicles, "Currency": "EUR", "Value": 900, "Tags": []string{"family"}},
+		http.StatusCreated), &change)
+	path := "/api/v2/items/" + strconv.Itoa(change.Item.Id)
+
+	// only the fields named change
+	item := patchTestItem(alice, path, map[string]interface{}{"Value": 800, "Version": 1})
+	if item.Value != 800 || item.Name != "Car" || item.Category != ItemCategoryVehicles || item.Currency != "EUR" ||
+		len(item.Tags) != 1 || item.Version != 2 {
+		t.Fatalf("patching the value gave %+v", item)
+	}
+
+	// null removes optional fields, which fall back to their defaults
+	item = patchTestItem(alice, path, `{"Category": null, "Currency": null, "Tags": null, "Version": 2}`)
+	if item.Category != ItemCategoryOther || item.Currency != "USD" || len(item.Tags) != 0 || item.Value != 800 {
+		t.Errorf("removing the optional fields gave %+v", item)
+	}
+}
+
+func TestV2PatchRefusesBadPatches(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.login(t, "alice")
+	item := addTestItem(alice, "House", 500)
+	path := "/api/v2/items/" + strconv.Itoa(item.Id)
+
+	for _, test := range []struct {
+		patch string
+		code  string
+	}{
+		// required fields can't be removed
+		{`{"Name": null, "Version": 1}`, "invalid_request"},
+		{`{"Type": null, "Version": 1}`, "invalid_request"},
+		{`{"Value": null, "Version": 1}`, "invalid_request"},
+		// nor can fields be made up, or the patch be anything but an object
+		{`{"Colour": "red", "Version": 1}`, "invalid_request"},
+		{`[{"Value": 1}]`, "invalid_request"},
+		{`{"Version": "one"}`, "invalid_request"},
+		// and the merged item must still be a valid one
+		{`{"Name": "x", "Version": 1}`, "invalid_item_name"},
+		{`{"Type": "Car", "Version": 1}`, "invalid_item_type"},
+		{`{"Category": "yachts", "Version": 1}`, "invalid_item_category"},
+	} {
+		content := alice.expect(http.MethodPatch, path, test.patch, http.StatusBadRequest)
+		expectErrorCode(t, content, test.code)
+	}
+
+	var response ErrorResponse
+	decodeTestBody(t, alice.expect(http.MethodPatch, path, `{"Value": null, "Version": 1}`, http.StatusBadRequest), &response)
+	if response.Field != "Value" {
+		t.Errorf("removing the value was blamed on %q", response.Field)
+	}
+	expectItemUnchanged(t, api.da, item)
+}
+
+func TestV2PatchChecksTheVersion(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.login(t, "alice")
+	item := addTestItem(alice, "House", 500)
+	path := "/api/v2/items/" + strconv.Itoa(item.Id)
+
+	content := alice.expect(http.MethodPatch, path, map[string]interface{}{"Value": 1}, http.StatusPreconditionRequired)
+	expectErrorCode(t, content, "item_version_required")
+	content = alice.expect(http.MethodPatch, path, map[string]interface{}{"Value": 1, "Version": 7}, http.StatusConflict)
+	expectErrorCode(t, content, "item_version_conflict")
+	content = alice.expect(http.MethodPatch, path, map[string]interface{}{"Value": 1}, http.StatusPreconditionFailed, "If-Match", `"7"`)
+	expectErrorCode(t, content, "item_version_conflict")
+	expectItemUnchanged(t, api.da, item)
+
+	// If-Match takes the place of a Version in the body, and the new ETag comes back
+	response, content := alice.do(http.MethodPatch, path, map[string]interface{}{"Value": 600}, "If-Match", `"1"`)
+	if response.StatusCode != http.StatusOK || response.Header.Get("ETag") != `"2"` {
+		t.Fatalf("patching with If-Match gave %d with ETag %q: %s", response.StatusCode, response.Header.Get("ETag"), content)
+	}
+	if item := patchTestItem(alice, path, map[string]interface{}{"Value": 700}, "If-Match", "*"); item.Value != 700 || item.Version != 3 {
+		t.Errorf("patching any version gave %+v", item)
+	}
+}